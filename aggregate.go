@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+)
+
+// aggregateRule is the rule named in the comment of aggregates.
+const aggregateRule = "aggregate"
+
+// aggregate is a covering prefix which replaced a number of entries on a
+// banlist. The members are kept, so they can be put back when the
+// aggregate is split again.
+type aggregate struct {
+	list    string
+	net     net.IPNet
+	members []BlackIP
+}
+
+// coveringPrefix returns the prefix ip gets aggregated into, or false when
+// ip is not subject to aggregation.
+func coveringPrefix(ip net.IPNet) (net.IPNet, bool) {
+	bits, total := cfg.Settings.AggregateIPv4, 8*net.IPv4len
+	if ip.IP.To4() == nil {
+		bits, total = cfg.Settings.AggregateIPv6, 8*net.IPv6len
+	}
+	if ones, _ := ip.Mask.Size(); ones <= bits {
+		return net.IPNet{}, false
+	}
+	mask := net.CIDRMask(bits, total)
+	return net.IPNet{IP: ip.IP.Mask(mask), Mask: mask}, true
+}
+
+// aggregate replaces the entries on list in the same covering prefix as ip
+// by the covering prefix itself, once there are more than the configured
+// number of them. The covering prefix lives as long as the longest living
+// entry it replaces. Prefixes overlapping the whitelist are never
+// aggregated.
+func (mt *Mikrotik) aggregate(ctx context.Context, list string, ip net.IPNet) error {
+	if cfg.Settings.AggregateCount == 0 {
+		return nil
+	}
+	if list == mt.banlist {
+		list = ""
+	}
+	cover, ok := coveringPrefix(ip)
+	if !ok {
+		return nil
+	}
+	key := list + " " + cover.String()
+	now := time.Now()
+
+	var (
+		members []BlackIP
+		dead    time.Time
+	)
+	mt.RLock()
+	_, exists := mt.aggregates[key]
+	for _, v := range mt.dynlist {
+		if v.List == list && v.Dead.After(now) && covers(cover, v.Net) && !covers(v.Net, cover) {
+			members = append(members, v)
+			if v.Dead.After(dead) {
+				dead = v.Dead
+			}
+		}
+	}
+	mt.RUnlock()
+	if exists || len(members) <= cfg.Settings.AggregateCount {
+		return nil
+	}
+	for _, w := range mt.whitelist {
+		if overlaps(w.Net, cover) {
+			if *debug || cfg.Settings.Verbose {
+				log.Printf("%s: not aggregating %s, it overlaps whitelist entry %s", mt.Name, cover.String(), w.Net.String())
+			}
+			return nil
+		}
+	}
+
+	log.Printf("%s(%s): aggregating %d entries into %s", mt.Name, mt.listName(list), len(members), cover.String())
+	mt.Lock()
+	mt.aggregates[key] = &aggregate{list, cover, members}
+	mt.Unlock()
+	if err := mt.AddIP(ctx, list, cover, Duration(time.Until(dead)), newComment(aggregateRule, time.Now(), len(members)).String()); err != nil {
+		return err
+	}
+	for _, v := range members {
+		if err := mt.DelIP(ctx, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverAggregates rebuilds the aggregates on the dynlist which are not
+// known yet, like after a restart, taking their members from the live
+// bans of the Mikrotik in the ban database, so they can be split again.
+func (mt *Mikrotik) recoverAggregates() {
+	active := bans.activeOn(mt.Name)
+	now := time.Now()
+	mt.Lock()
+	defer mt.Unlock()
+	for _, v := range mt.dynlist {
+		if v.Comment == nil || v.Comment.Rule != aggregateRule {
+			continue
+		}
+		key := v.List + " " + v.Net.String()
+		if _, ok := mt.aggregates[key]; ok {
+			continue
+		}
+		a := &aggregate{list: v.List, net: v.Net}
+		for _, b := range active {
+			if b.List == v.List && b.Dead.After(now) && covers(v.Net, b.Net) && !covers(b.Net, v.Net) {
+				a.members = append(a.members, b)
+			}
+		}
+		mt.aggregates[key] = a
+		if *debug || cfg.Settings.Verbose {
+			log.Printf("%s(%s): recovered aggregate %s with %d entries", mt.Name, mt.listName(v.List), v.Net.String(), len(a.members))
+		}
+	}
+}
+
+// splitAggregates puts back the remaining members of every aggregate which
+// has no more than the configured number of live members left, or which is
+// about to expire itself.
+func (mt *Mikrotik) splitAggregates(ctx context.Context) error {
+	now := time.Now()
+	var split []*aggregate
+	mt.Lock()
+	for k, a := range mt.aggregates {
+		var alive []BlackIP
+		for _, v := range a.members {
+			if v.Dead.After(now) {
+				alive = append(alive, v)
+			}
+		}
+		a.members = alive
+		var entry *BlackIP
+		for i, v := range mt.dynlist {
+			if v.List == a.list && v.Net.String() == a.net.String() {
+				entry = &mt.dynlist[i]
+				break
+			}
+		}
+		if len(alive) > cfg.Settings.AggregateCount && entry != nil && entry.Dead.After(now.Add(time.Minute)) {
+			continue
+		}
+		delete(mt.aggregates, k)
+		split = append(split, a)
+	}
+	mt.Unlock()
+
+	for _, a := range split {
+		log.Printf("%s(%s): splitting %s back into %d entries", mt.Name, mt.listName(a.list), a.net.String(), len(a.members))
+		// Remove the aggregate first, or it would shadow its members.
+		mt.RLock()
+		var entries []BlackIP
+		for _, v := range mt.dynlist {
+			if v.List == a.list && v.Net.String() == a.net.String() {
+				entries = append(entries, v)
+			}
+		}
+		mt.RUnlock()
+		for _, v := range entries {
+			if err := mt.DelIP(ctx, v); err != nil {
+				return err
+			}
+		}
+		for _, v := range a.members {
+			if err := mt.AddIP(ctx, a.list, v.Net, Duration(time.Until(v.Dead)), v.Comment.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runAggregates splits aggregates every minute, until ctx is done.
+func (mt *Mikrotik) runAggregates(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := mt.splitAggregates(ctx); err != nil {
+				log.Printf("%s: %v", mt.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCoveringPrefix(t *testing.T) {
+	cfg.Settings.AggregateIPv4 = 24
+	cfg.Settings.AggregateIPv6 = 48
+	defer func() { cfg = Config{} }()
+
+	testdata := []struct {
+		ip     string
+		cover  string
+		expect bool
+	}{
+		{"1.2.3.4/32", "1.2.3.0/24", true},
+		{"1.2.3.0/25", "1.2.3.0/24", true},
+		{"1.2.3.0/24", "", false},
+		{"1.2.0.0/16", "", false},
+		{"2001:db8:1:2::1/128", "2001:db8:1::/48", true},
+		{"2001:db8:1::/48", "", false},
+	}
+	for _, d := range testdata {
+		_, ip, err := net.ParseCIDR(d.ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cover, ok := coveringPrefix(*ip)
+		if ok != d.expect {
+			t.Errorf("coveringPrefix(%s) = %t, expected %t", d.ip, ok, d.expect)
+			continue
+		}
+		if ok && cover.String() != d.cover {
+			t.Errorf("coveringPrefix(%s) = %s, expected %s", d.ip, cover.String(), d.cover)
+		}
+	}
+}
+
+func TestRecoverAggregates(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	db, err := loadBanDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bans = db
+	defer func() { cfg, bans = Config{}, nil }()
+
+	now := time.Now()
+	for _, d := range []struct {
+		ip    string
+		until time.Duration
+		mts   []string
+	}{
+		{"192.0.2.1/32", time.Hour, []string{"MT-1", "MT-2"}},
+		{"192.0.2.2/32", time.Hour, []string{"MT-1"}},
+		{"192.0.2.3/32", -time.Hour, []string{"MT-1"}},
+		{"192.0.2.4/32", time.Hour, []string{"MT-2"}},
+		{"198.51.100.1/32", time.Hour, []string{"MT-1"}},
+	} {
+		ip := *parseCIDR(d.ip, false)
+		bans.record("", ip, now.Add(d.until), "sshd", "", "test", "test", d.mts)
+		for _, mt := range d.mts {
+			bans.setStatus("", ip, mt, "banned")
+		}
+	}
+
+	cover := *parseCIDR("192.0.2.0/24", false)
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist", aggregates: make(map[string]*aggregate), dynlist: []BlackIP{
+		{Net: cover, Dead: now.Add(time.Hour), Comment: newComment(aggregateRule, now, 3)},
+		{Net: *parseCIDR("198.51.100.1/32", false), Dead: now.Add(time.Hour), Comment: newComment("sshd", now, 1)},
+	}}
+	mt.recoverAggregates()
+
+	// Only the live bans on this Mikrotik inside the aggregate are members.
+	a, ok := mt.aggregates[" "+cover.String()]
+	if !ok {
+		t.Fatalf("aggregates = %v, expected %s to be recovered", mt.aggregates, cover.String())
+	}
+	got := map[string]bool{}
+	for _, v := range a.members {
+		got[v.Net.String()] = true
+	}
+	if len(got) != 2 || !got["192.0.2.1/32"] || !got["192.0.2.2/32"] {
+		t.Errorf("members = %v, expected 192.0.2.1/32 and 192.0.2.2/32", a.members)
+	}
+	if len(mt.aggregates) != 1 {
+		t.Errorf("aggregates = %v, expected only %s", mt.aggregates, cover.String())
+	}
+}
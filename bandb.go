@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// banDBFile is the name of the file in the state directory holding
+	// the ban database.
+	banDBFile = "bans.json"
+	// banRetention is how long a ban is remembered after it ended.
+	banRetention = 30 * 24 * time.Hour
+)
+
+// banEntry is everything known about the ban of a single prefix on an
+// address list, the empty list being the banlist of every Mikrotik. Hits
+// is the number of times it got banned, Until the end of the current ban.
+// Jail, Rule, Reason and Source are those of the last ban: the jail and
+// rule matching, the message matched and its sender. Routers holds the
+// status of the ban on every Mikrotik.
+type banEntry struct {
+	Prefix    string
+	List      string `json:",omitempty"`
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Hits      int
+	Until     time.Time
+	Jail      string            `json:",omitempty"`
+	Rule      string            `json:",omitempty"`
+	Reason    string            `json:",omitempty"`
+	Source    string            `json:",omitempty"`
+	Routers   map[string]string `json:",omitempty"`
+}
+
+// banDB is the database of all bans, kept in the state directory. It is
+// the source of truth when reconciling the Mikrotiks, which may lose
+// entries. Changes are saved once a second at most.
+type banDB struct {
+	sync.Mutex
+	bans  map[string]*banEntry
+	dirty bool
+}
+
+// bans is the ban database, nil when not loaded, like in tests.
+var bans *banDB
+
+// banKey returns the key of the ban of ip on list.
+func banKey(list string, ip net.IPNet) string {
+	return list + " " + ip.String()
+}
+
+// loadBanDB returns the ban database as saved in the state directory.
+func loadBanDB() (*banDB, error) {
+	db := &banDB{bans: make(map[string]*banEntry)}
+	if err := loadState(banDBFile, &db.bans); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// run saves the database every second when it changed, until ctx is done.
+// Bans which ended longer than banRetention ago are forgotten.
+func (db *banDB) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		db.Lock()
+		if db.dirty {
+			for k, v := range db.bans {
+				if time.Since(v.Until) > banRetention {
+					delete(db.bans, k)
+				}
+			}
+			if err := saveState(banDBFile, db.bans); err != nil {
+				log.Printf("Unable to save ban database: %v", err)
+			} else {
+				db.dirty = false
+			}
+		}
+		db.Unlock()
+	}
+}
+
+// entry returns the entry of ip on list, creating it when needed. The
+// caller holds the lock.
+func (db *banDB) entry(list string, ip net.IPNet, now time.Time) *banEntry {
+	key := banKey(list, ip)
+	e, ok := db.bans[key]
+	if !ok {
+		e = &banEntry{Prefix: ip.String(), List: list, FirstSeen: now, Routers: make(map[string]string)}
+		db.bans[key] = e
+	}
+	if e.Routers == nil {
+		e.Routers = make(map[string]string)
+	}
+	db.dirty = true
+	return e
+}
+
+// record adds a ban of ip on list until the given time, for the reason
+// given, to the database. The Mikrotiks it is applied to are marked
+// pending. It returns when the prefix was first seen and its hit count.
+func (db *banDB) record(list string, ip net.IPNet, until time.Time, jail, rule, reason, source string, mts []string) (time.Time, int) {
+	now := time.Now()
+	if db == nil {
+		return now, 1
+	}
+	db.Lock()
+	defer db.Unlock()
+	e := db.entry(list, ip, now)
+	e.LastSeen = now
+	e.Hits++
+	if until.After(e.Until) {
+		e.Until = until
+	}
+	e.Jail, e.Rule, e.Reason, e.Source = jail, rule, reason, source
+	for _, name := range mts {
+		e.Routers[name] = "pending"
+	}
+	return e.FirstSeen, e.Hits
+}
+
+// recover adds what the comment of an entry found on a Mikrotik tells
+// about its ban, for when the database lost it.
+func (db *banDB) recover(mt string, v BlackIP) {
+	if db == nil || v.Comment == nil {
+		return
+	}
+	db.Lock()
+	defer db.Unlock()
+	e, ok := db.bans[banKey(v.List, v.Net)]
+	if !ok {
+		e = db.entry(v.List, v.Net, v.Comment.First)
+		e.LastSeen, e.Hits, e.Jail = v.Comment.First, v.Comment.Hits, v.Comment.Rule
+		e.Reason = "recovered from " + mt
+	}
+	if v.Dead.After(e.Until) {
+		e.Until = v.Dead
+	}
+	if e.Routers[mt] != "banned" {
+		e.Routers[mt] = "banned"
+		db.dirty = true
+	}
+}
+
+// setStatus records the status of the ban of ip on list on a Mikrotik.
+func (db *banDB) setStatus(list string, ip net.IPNet, mt, status string) {
+	if db == nil {
+		return
+	}
+	db.Lock()
+	defer db.Unlock()
+	if e, ok := db.bans[banKey(list, ip)]; ok && e.Routers[mt] != status {
+		e.Routers[mt] = status
+		db.dirty = true
+	}
+}
+
+// unban ends the ban of ip on list now, on all Mikrotiks.
+func (db *banDB) unban(list string, ip net.IPNet, reason string) {
+	if db == nil {
+		return
+	}
+	db.Lock()
+	defer db.Unlock()
+	e, ok := db.bans[banKey(list, ip)]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	e.Until, e.LastSeen, e.Reason = now, now, reason
+	for k := range e.Routers {
+		e.Routers[k] = "removed"
+	}
+	db.dirty = true
+}
+
+// active returns the bans which have not ended yet, as BlackIPs.
+func (db *banDB) active() []BlackIP {
+	return db.activeOn("")
+}
+
+// activeOn returns the bans which have not ended yet on the named
+// Mikrotik, as BlackIPs. The empty name returns those of all of them.
+func (db *banDB) activeOn(mt string) []BlackIP {
+	if db == nil {
+		return nil
+	}
+	db.Lock()
+	defer db.Unlock()
+	now := time.Now()
+	var ips []BlackIP
+	for _, e := range db.bans {
+		if !e.Until.After(now) {
+			continue
+		}
+		if s := e.Routers[mt]; mt != "" && (s == "" || s == "removed") {
+			continue
+		}
+		if ip := parseCIDR(e.Prefix, false); ip != nil {
+			ips = append(ips, BlackIP{*ip, e.Until, "", e.List, newComment(e.Jail, e.FirstSeen, e.Hits)})
+		}
+	}
+	return ips
+}
+
+// dump writes the database to w, most recent bans first.
+func (db *banDB) dump(w io.Writer) error {
+	db.Lock()
+	entries := make([]*banEntry, 0, len(db.bans))
+	for _, e := range db.bans {
+		entries = append(entries, e)
+	}
+	db.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].LastSeen.After(entries[j].LastSeen) })
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "PREFIX\tLIST\tHITS\tFIRST SEEN\tLAST SEEN\tUNTIL\tJAIL\tSOURCE\tROUTERS\tREASON")
+	for _, e := range entries {
+		var routers []string
+		for k, v := range e.Routers {
+			routers = append(routers, k+"="+v)
+		}
+		sort.Strings(routers)
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%v\t%s\n", e.Prefix, e.List, e.Hits,
+			e.FirstSeen.Format(time.RFC3339), e.LastSeen.Format(time.RFC3339), e.Until.Format(time.RFC3339),
+			e.Jail, e.Source, routers, e.Reason)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBanDB(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	db, err := loadBanDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ip, _ := net.ParseCIDR("192.0.2.1/32")
+	_, ip2, _ := net.ParseCIDR("192.0.2.2/32")
+	until := time.Now().Add(time.Hour).Round(time.Second)
+	db.record("", *ip, until, "sshd", "Failed password", "Failed password for root", "192.0.2.10:514", []string{"MT-1", "MT-2"})
+	db.record("", *ip, until.Add(-time.Minute), "sshd", "Failed password", "Failed password for admin", "192.0.2.10:514", []string{"MT-1"})
+	db.setStatus("", *ip, "MT-1", "banned")
+	db.setStatus("", *ip2, "MT-1", "banned")
+	db.record("voip", *ip2, until, "asterisk", "", "Wrong password", "pbx", []string{"MT-1"})
+	db.unban("voip", *ip2, "removed by hand on MT-1")
+
+	e := db.bans[banKey("", *ip)]
+	if e.Hits != 2 || !e.Until.Equal(until) || e.Reason != "Failed password for admin" {
+		t.Errorf("entry = %+v, expected 2 hits until %s", e, until)
+	}
+	if e.Routers["MT-1"] != "banned" || e.Routers["MT-2"] != "pending" {
+		t.Errorf("Routers = %v, expected MT-1 banned and MT-2 pending", e.Routers)
+	}
+	if e := db.bans[banKey("voip", *ip2)]; e.Routers["MT-1"] != "removed" {
+		t.Errorf("Routers = %v after unban, expected MT-1 removed", e.Routers)
+	}
+	if ips := db.active(); len(ips) != 1 || ips[0].Net.String() != "192.0.2.1/32" || ips[0].List != "" {
+		t.Errorf("active() = %v, expected only 192.0.2.1/32", ips)
+	}
+
+	// It survives a restart.
+	if err := saveState(banDBFile, db.bans); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = loadBanDB(); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.bans) != 2 || db.bans[banKey("", *ip)].Hits != 2 {
+		t.Errorf("loadBanDB() = %v, expected the saved bans", db.bans)
+	}
+	var sb strings.Builder
+	if err := db.dump(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(sb.String(), "[MT-1=banned MT-2=pending]") {
+		t.Errorf("dump() = %q, expected the router status", sb.String())
+	}
+
+	// A nil database ignores everything.
+	var none *banDB
+	none.record("", *ip, until, "", "", "", "", nil)
+	if none.active() != nil {
+		t.Errorf("active() of nil database is not nil")
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxCommentLen bounds the length of the comments we write.
+	maxCommentLen = 64
+	// maxCommentName bounds the rule and instance names in a comment.
+	maxCommentName = 16
+	// maxCommentHits bounds the hit count in a comment.
+	maxCommentHits = 99999
+	// adoptedFile is the name of the file in the state directory holding
+	// the Mikrotiks whose entries of older versions were adopted.
+	adoptedFile = "adopted.json"
+)
+
+// banComment is the metadata kept in the comment of the address list
+// entries we create: the rule (jail) banning it, the fwban instance owning
+// it, when it was first seen and how often it was banned. It is formatted
+// as "fwban r=sshd i=gw1 f=1704067200 n=3", so entries created by others
+// can be told apart.
+type banComment struct {
+	Rule     string
+	Instance string
+	First    time.Time
+	Hits     int
+}
+
+// commentName returns s with every character RouterOS might mangle, and
+// the separators of the format, replaced by an underscore, shortened to
+// maxCommentName.
+func commentName(s string) string {
+	b := []byte(s)
+	if len(b) > maxCommentName {
+		b = b[:maxCommentName]
+	}
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == '@') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+// instanceName returns the name this fwban instance marks its entries
+// with: the instance setting, or the short hostname. Entries of an earlier
+// name are only taken over when listed in the adopt setting.
+func instanceName() string {
+	if cfg.Settings.Instance != "" {
+		return commentName(cfg.Settings.Instance)
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "fwban"
+	}
+	return commentName(strings.SplitN(host, ".", 2)[0])
+}
+
+// newComment returns the comment of an entry created by this instance.
+func newComment(rule string, first time.Time, hits int) *banComment {
+	return &banComment{Rule: rule, Instance: instanceName(), First: first, Hits: hits}
+}
+
+// String formats the comment, never longer than maxCommentLen.
+func (c *banComment) String() string {
+	if c == nil {
+		return ""
+	}
+	s := fmt.Sprintf("fwban r=%s i=%s f=%d n=%d", commentName(c.Rule), commentName(c.Instance), c.First.Unix(), min(c.Hits, maxCommentHits))
+	if len(s) > maxCommentLen {
+		s = s[:maxCommentLen]
+	}
+	return s
+}
+
+// parseComment parses the comment of an address list entry, returning nil
+// when it was not created by fwban. Unknown fields are skipped, so later
+// versions can add some.
+func parseComment(s string) *banComment {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || fields[0] != "fwban" {
+		return nil
+	}
+	c := &banComment{}
+	for _, f := range fields[1:] {
+		k, v, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil
+		}
+		switch k {
+		case "r":
+			c.Rule = v
+		case "i":
+			c.Instance = v
+		case "f":
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil
+			}
+			c.First = time.Unix(t, 0)
+		case "n":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil
+			}
+			c.Hits = n
+		}
+	}
+	if c.Instance == "" {
+		return nil
+	}
+	return c
+}
+
+// ours reports whether the entry was created by this fwban instance.
+func (b BlackIP) ours() bool {
+	return b.Comment != nil && b.Comment.Instance == instanceName()
+}
+
+// adopted holds when the entries of older versions were adopted, for every
+// Mikrotik, see adopt. It is loaded from the state directory when first
+// needed.
+var adopted struct {
+	sync.Mutex
+	when map[string]time.Time
+}
+
+// adoptedBefore reports whether the entries of older versions on the named
+// Mikrotik were adopted by an earlier run.
+func adoptedBefore(name string) (bool, error) {
+	adopted.Lock()
+	defer adopted.Unlock()
+	if adopted.when == nil {
+		adopted.when = make(map[string]time.Time)
+		if err := loadState(adoptedFile, &adopted.when); err != nil {
+			adopted.when = nil
+			return false, err
+		}
+	}
+	_, ok := adopted.when[name]
+	return ok, nil
+}
+
+// markAdopted records the entries of older versions on the named Mikrotik
+// as adopted, so later runs leave those added by hand alone.
+func markAdopted(name string) {
+	adopted.Lock()
+	defer adopted.Unlock()
+	if _, ok := adopted.when[name]; ok || adopted.when == nil {
+		return
+	}
+	adopted.when[name] = time.Now()
+	if err := saveState(adoptedFile, adopted.when); err != nil {
+		log.Printf("Unable to save %s: %v", adoptedFile, err)
+	}
+}
+
+// adopting reports whether the entries of the named instance are taken
+// over, as listed in the adopt setting.
+func adopting(instance string) bool {
+	for _, v := range cfg.Settings.Adopt {
+		if commentName(v) == instance {
+			return true
+		}
+	}
+	return false
+}
+
+// adopt takes over a dynamic entry on a managed banlist not created by this
+// instance, reporting whether it is ours now. Entries without comment,
+// written by older versions, are adopted when legacy is set, on the first
+// run only. Those of the instances in the adopt setting, like the old
+// hostname, always are. Their comment is rewritten, so from then on they
+// are ours.
+func (mt *Mikrotik) adopt(ctx context.Context, v *BlackIP, legacy bool) (bool, error) {
+	if v.ours() {
+		return true, nil
+	}
+	if v.Dead.IsZero() {
+		return false, nil
+	}
+	var c banComment
+	switch {
+	case v.Comment == nil && legacy:
+		c = *newComment("adopted", time.Now(), 1)
+	case v.Comment != nil && adopting(v.Comment.Instance):
+		c = *v.Comment
+		c.Instance = instanceName()
+	default:
+		return false, nil
+	}
+	cmd := "/ip/firewall/address-list/set"
+	if v.Net.IP.To4() == nil {
+		cmd = "/ipv6/firewall/address-list/set"
+	}
+	if _, err := mt.run(ctx, cmd, "=.id="+v.ID, "=comment="+c.String()); err != nil {
+		return false, fmt.Errorf("%s: adopting %s: %w", mt.Name, v.Net.String(), err)
+	}
+	if *debug || cfg.Settings.Verbose {
+		log.Printf("%s(%s): adopted entry %s", mt.Name, mt.listName(v.List), v.Net.String())
+	}
+	v.Comment = &c
+	return true, nil
+}
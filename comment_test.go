@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ros "github.com/go-routeros/routeros/v3"
+)
+
+func TestComment(t *testing.T) {
+	cfg.Settings.Instance = "gw1"
+	defer func() { cfg = Config{} }()
+
+	first := time.Unix(1704067200, 0)
+	c := newComment("sshd", first, 3)
+	if got := c.String(); got != "fwban r=sshd i=gw1 f=1704067200 n=3" {
+		t.Errorf("String() = %q", got)
+	}
+	if got := parseComment(c.String()); got == nil || *got != *c {
+		t.Errorf("parseComment(%q) = %+v, expected %+v", c.String(), got, c)
+	}
+
+	// Names are sanitized and bounded.
+	long := newComment("a very \"long\" jail name; really", first, 1234567)
+	long.Instance = strings.Repeat("x", 40)
+	s := long.String()
+	if len(s) > maxCommentLen || strings.ContainsAny(s, "\";") {
+		t.Errorf("String() = %q, expected at most %d safe characters", s, maxCommentLen)
+	}
+	if got := parseComment(s); got == nil || got.Rule != "a_very__long__ja" || got.Hits != maxCommentHits {
+		t.Errorf("parseComment(%q) = %+v", s, got)
+	}
+
+	// Comments not written by us.
+	for _, s := range []string{"", "Failed password for root", "fwban", "fwban r=sshd", "fwban i=gw1 f=yesterday", "fwban i=gw1 garbage"} {
+		if got := parseComment(s); got != nil {
+			t.Errorf("parseComment(%q) = %+v, expected nil", s, got)
+		}
+	}
+	// Unknown fields are skipped.
+	if got := parseComment("fwban r=sshd i=gw1 f=1704067200 n=3 x=later"); got == nil || got.Hits != 3 {
+		t.Errorf("parseComment() = %+v, expected unknown fields to be skipped", got)
+	}
+
+	// Only entries of this instance are ours.
+	if !(BlackIP{Comment: c}).ours() {
+		t.Errorf("ours() = false for our own entry")
+	}
+	if (BlackIP{Comment: &banComment{Instance: "gw2"}}).ours() || (BlackIP{}).ours() {
+		t.Errorf("ours() = true for an entry of others")
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	cfg.Settings.Instance = "gw1"
+	cfg.Settings.Adopt = []string{"oldname"}
+	defer func() { cfg = Config{} }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	go fakeRouter(t, l)
+	ctx := context.Background()
+	client, err := ros.DialContext(ctx, l.Addr().String(), "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	client.Async()
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist"}
+	mt.client.Store(client)
+
+	entry := func(c *banComment, d time.Duration) BlackIP {
+		v := BlackIP{Net: *parseCIDR("192.0.2.1/32", false), ID: "*1", Comment: c}
+		if d != 0 {
+			v.Dead = time.Now().Add(d)
+		}
+		return v
+	}
+	renamed := &banComment{Rule: "sshd", Instance: "oldname", First: time.Unix(1704067200, 0), Hits: 3}
+	testdata := []struct {
+		name   string
+		v      BlackIP
+		legacy bool
+		expect bool
+	}{
+		{"Ours", entry(newComment("sshd", time.Now(), 1), time.Hour), false, true},
+		{"Legacy", entry(nil, time.Hour), true, true},
+		{"LegacyAfterFirstRun", entry(nil, time.Hour), false, false},
+		{"Permanent", entry(nil, 0), true, false},
+		{"Renamed", entry(renamed, time.Hour), false, true},
+		{"OtherInstance", entry(&banComment{Instance: "gw2"}, time.Hour), true, false},
+	}
+	for _, d := range testdata {
+		t.Run(d.name, func(t *testing.T) {
+			ours, err := mt.adopt(ctx, &d.v, d.legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ours != d.expect || ours != d.v.ours() {
+				t.Errorf("adopt() = %t, ours() = %t, expected %t", ours, d.v.ours(), d.expect)
+			}
+		})
+	}
+	// The history of renamed entries is kept.
+	v := entry(renamed, time.Hour)
+	if _, err := mt.adopt(ctx, &v, false); err != nil || v.Comment.Hits != 3 || v.Comment.Rule != "sshd" {
+		t.Errorf("adopt() = %v, comment %+v, expected the hits and rule to be kept", err, v.Comment)
+	}
+
+	// Adoption of older entries happens on the first run only.
+	if before, err := adoptedBefore("MT-1"); err != nil || before {
+		t.Errorf("adoptedBefore() = %t, %v, expected false", before, err)
+	}
+	markAdopted("MT-1")
+	adopted.when = nil
+	defer func() { adopted.when = nil }()
+	if before, err := adoptedBefore("MT-1"); err != nil || !before {
+		t.Errorf("adoptedBefore() = %t, %v after a restart, expected true", before, err)
+	}
+}
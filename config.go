@@ -4,7 +4,8 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,6 +24,42 @@ type ConfigMikrotik struct {
 	BanList   string
 	Whitelist []string `json:",omitempty"`
 	Blacklist []string `json:",omitempty"`
+	Source    []string `json:",omitempty"`
+}
+
+// ConfigFile is the internal representation of a file object, naming the
+// log files to tail, initialized from the configfile.
+type ConfigFile struct {
+	Disabled bool
+	Path     []string
+}
+
+// ConfigJail is the internal representation of a jail object, grouping a
+// set of regexps with the way their matches are banned, initialized from
+// the configfile. Zero values are inherited from the settings section, an
+// empty banlist means the banlist of the Mikrotik and no Mikrotik entries
+// means the jail applies to all of them.
+type ConfigJail struct {
+	Disabled   bool
+	Filter     string   `json:",omitempty"`
+	RE         []string `json:",omitempty"`
+	TestRE     []string `json:"test-re,omitempty" gcfg:"test-re"`
+	IgnoreRE   []string `json:"ignore-re,omitempty" gcfg:"ignore-re"`
+	TestIgnore []string `json:"test-ignore,omitempty" gcfg:"test-ignore"`
+	Hostname   []string `json:",omitempty"`
+	Tag        []string `json:",omitempty"`
+	Facility   []string `json:",omitempty"`
+	Severity   []string `json:",omitempty"`
+	SDIP       string   `json:"sd-ip,omitempty" gcfg:"sd-ip"`
+	SDMatch    []string `json:"sd-match,omitempty" gcfg:"sd-match"`
+	JSONIP     string   `json:"json-ip,omitempty" gcfg:"json-ip"`
+	JSONMatch  []string `json:"json-match,omitempty" gcfg:"json-match"`
+	BlockTime  Duration `json:",omitempty"`
+	MaxRetry   int      `json:",omitempty"`
+	FindTime   Duration `json:",omitempty"`
+	BanList    string   `json:",omitempty"`
+	Mikrotik   []string `json:",omitempty"`
+	Local      bool     `json:",omitempty"`
 }
 
 // Config is the internal representation of the config file, read during
@@ -30,25 +67,56 @@ type ConfigMikrotik struct {
 // Note that missing elements are inititalized to a sensible default.
 type Config struct {
 	Settings struct {
-		BlockTime  Duration
-		AutoDelete bool
-		Verbose    bool
-		Port       uint16
+		BlockTime     Duration
+		AutoDelete    bool
+		Verbose       bool
+		Port          uint16
+		TCPPort       uint16 `json:",omitempty"`
+		TLSPort       uint16 `json:",omitempty"`
+		TLSCert       string `json:",omitempty"`
+		TLSKey        string `json:",omitempty"`
+		TLSCA         string `json:",omitempty"`
+		UnixSocket    string `json:",omitempty"`
+		UnixType      string `json:",omitempty"`
+		UnixMode      string `json:",omitempty"`
+		StateDir      string
+		MetricsAddr   string   `json:",omitempty"`
+		Reconcile     Duration `json:",omitempty"`
+		Instance      string   `json:",omitempty"`
+		Adopt         []string `json:",omitempty"`
+		BanPrefixIPv4 int
+		BanPrefixIPv6 int
+		MaxRetry      int      `json:",omitempty"`
+		FindTime      Duration `json:",omitempty"`
+		MaxTracked    int      `json:",omitempty"`
+
+		RecidiveFactor    float64  `json:",omitempty"`
+		RecidiveMax       Duration `json:",omitempty"`
+		RecidivePermanent int      `json:",omitempty"`
+		RecidiveForget    Duration `json:",omitempty"`
+
+		AggregateCount int `json:",omitempty"`
+		AggregateIPv4  int `json:",omitempty"`
+		AggregateIPv6  int `json:",omitempty"`
 	}
 	RegExps struct {
-		RE     []string `json:",omitempty"`
-		TestRE []string `json:"test-re,omitempty" gcfg:"test-re"`
+		RE         []string `json:",omitempty"`
+		TestRE     []string `json:"test-re,omitempty" gcfg:"test-re"`
+		IgnoreRE   []string `json:"ignore-re,omitempty" gcfg:"ignore-re"`
+		TestIgnore []string `json:"test-ignore,omitempty" gcfg:"test-ignore"`
+		Hostname   []string `json:",omitempty"`
+		Tag        []string `json:",omitempty"`
+		Facility   []string `json:",omitempty"`
+		Severity   []string `json:",omitempty"`
 	}
-	re       []regexps
+	jails    []*jail
+	unixMode os.FileMode
 	Mikrotik map[string]*ConfigMikrotik `json:",omitempty"`
+	File     map[string]*ConfigFile     `json:",omitempty"`
+	Jail     map[string]*ConfigJail     `json:",omitempty"`
 }
 
-type regexps struct {
-	RE      *regexp.Regexp
-	IPIndex int
-}
-
-func (c *Config) mergeFlags(port uint16, blocktime Duration, autodelete, verbose bool) {
+func (c *Config) mergeFlags(port, tcpport uint16, blocktime Duration, autodelete, verbose bool) {
 	// Commandline flags override the config, but only when set
 	if blocktime != 0 {
 		c.Settings.BlockTime = blocktime
@@ -62,14 +130,95 @@ func (c *Config) mergeFlags(port uint16, blocktime Duration, autodelete, verbose
 	if port != 0 {
 		c.Settings.Port = port
 	}
+	if tcpport != 0 {
+		c.Settings.TCPPort = tcpport
+	}
 }
 
 func (c *Config) setupDefaults() error {
 	if c.Settings.BlockTime == 0 {
 		c.Settings.BlockTime = Duration(24 * time.Hour)
 	}
+	if c.Settings.StateDir == "" {
+		c.Settings.StateDir = "/var/lib/mikrotik-fwban"
+	}
+	if c.Settings.BanPrefixIPv4 == 0 {
+		c.Settings.BanPrefixIPv4 = 8 * net.IPv4len
+	}
+	if c.Settings.BanPrefixIPv6 == 0 {
+		c.Settings.BanPrefixIPv6 = 64
+	}
+	if c.Settings.BanPrefixIPv4 < 8 || c.Settings.BanPrefixIPv4 > 8*net.IPv4len {
+		return fmt.Errorf("banprefixipv4 must be between 8 and 32")
+	}
+	if c.Settings.BanPrefixIPv6 < 16 || c.Settings.BanPrefixIPv6 > 8*net.IPv6len {
+		return fmt.Errorf("banprefixipv6 must be between 16 and 128")
+	}
+	// Only keep track of hits when more than one is needed for a ban.
+	if c.Settings.MaxRetry > 1 {
+		if c.Settings.FindTime == 0 {
+			c.Settings.FindTime = Duration(10 * time.Minute)
+		}
+		if c.Settings.MaxTracked == 0 {
+			c.Settings.MaxTracked = 100000
+		}
+	}
+	if c.Settings.FindTime < 0 {
+		return fmt.Errorf("findtime must be positive")
+	}
+	if c.Settings.Reconcile < 0 {
+		return fmt.Errorf("reconcile must be positive")
+	}
+	if c.Settings.RecidiveFactor != 0 || c.Settings.RecidivePermanent != 0 {
+		if c.Settings.RecidiveFactor == 0 {
+			c.Settings.RecidiveFactor = 1
+		}
+		if c.Settings.RecidiveFactor < 1 {
+			return fmt.Errorf("recidivefactor must be at least 1")
+		}
+		if c.Settings.RecidiveMax == 0 || c.Settings.RecidiveMax > maxTimeout {
+			c.Settings.RecidiveMax = maxTimeout
+		}
+		if c.Settings.RecidiveForget == 0 {
+			c.Settings.RecidiveForget = Duration(30 * 24 * time.Hour)
+		}
+	}
+	if c.Settings.AggregateCount != 0 {
+		if c.Settings.AggregateIPv4 == 0 {
+			c.Settings.AggregateIPv4 = 24
+		}
+		if c.Settings.AggregateIPv6 == 0 {
+			c.Settings.AggregateIPv6 = 48
+		}
+		if c.Settings.AggregateIPv4 < 8 || c.Settings.AggregateIPv4 > 31 {
+			return fmt.Errorf("aggregateipv4 must be between 8 and 31")
+		}
+		if c.Settings.AggregateIPv6 < 16 || c.Settings.AggregateIPv6 > 127 {
+			return fmt.Errorf("aggregateipv6 must be between 16 and 127")
+		}
+	}
+	if c.Settings.TLSPort != 0 && (c.Settings.TLSCert == "" || c.Settings.TLSKey == "") {
+		return fmt.Errorf("tlsport requires both tlscert and tlskey")
+	}
+	if c.Settings.UnixSocket != "" {
+		switch c.Settings.UnixType {
+		case "":
+			c.Settings.UnixType = "dgram"
+		case "dgram", "stream":
+		default:
+			return fmt.Errorf("unixtype must be either dgram or stream, not %q", c.Settings.UnixType)
+		}
+		if c.Settings.UnixMode == "" {
+			c.Settings.UnixMode = "0666"
+		}
+		mode, err := strconv.ParseUint(c.Settings.UnixMode, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("unixmode must be an octal permission, not %q", c.Settings.UnixMode)
+		}
+		c.unixMode = os.FileMode(mode)
+	}
 	// Make sure we have a initial regex to start out with.
-	if len(c.RegExps.RE) == 0 {
+	if len(c.RegExps.RE) == 0 && len(c.Jail) == 0 {
 		return fmt.Errorf("need at least one valid regexp")
 	}
 
@@ -109,69 +258,119 @@ func (c *Config) setupDefaults() error {
 	if !hasActiveConfig {
 		return fmt.Errorf("need at least one active Mikrotik configuration")
 	}
+
+	for k, v := range c.File {
+		if !v.Disabled && len(v.Path) == 0 {
+			return fmt.Errorf("%s: path is a required field", k)
+		}
+	}
+
+	for k, v := range c.Jail {
+		if k == defaultJail {
+			return fmt.Errorf("%s: jail name is reserved for the regexps section", k)
+		}
+		if v.Disabled {
+			continue
+		}
+		if v.FindTime < 0 {
+			return fmt.Errorf("%s: findtime must be positive", k)
+		}
+		for _, name := range v.Mikrotik {
+			if _, ok := c.Mikrotik[name]; !ok {
+				return fmt.Errorf("%s: unknown Mikrotik %q", k, name)
+			}
+		}
+	}
 	return nil
 }
 
-func (c *Config) setupREs() error {
-	for _, v := range c.RegExps.RE {
-		re, err := regexp.Compile(v)
+// setupJails compiles the regexps of every jail, the regexps section being
+// the default jail, and checks them against their test-re entries. The
+// ignore-re entries of the regexps section apply to every jail.
+func (c *Config) setupJails() error {
+	var global []ignoreRE
+	for _, s := range c.RegExps.IgnoreRE {
+		ign, err := newIgnoreRE(s)
 		if err != nil {
 			return err
 		}
-		index := -1
-		for i, val := range re.SubexpNames() {
-			if val == "IP" {
-				if index >= 0 {
-					return fmt.Errorf("multiple named groups `IP` in regexp %q", v)
-				}
-				index = i
+		global = append(global, ign)
+	}
+	if len(c.RegExps.RE) != 0 {
+		j, err := c.newJail(defaultJail, &ConfigJail{
+			RE:       c.RegExps.RE,
+			TestRE:   c.RegExps.TestRE,
+			Hostname: c.RegExps.Hostname,
+			Tag:      c.RegExps.Tag,
+			Facility: c.RegExps.Facility,
+			Severity: c.RegExps.Severity,
+		}, global)
+		if err != nil {
+			return err
+		}
+		c.jails = append(c.jails, j)
+	}
+	names := make([]string, 0, len(c.Jail))
+	for k := range c.Jail {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if c.Jail[k].Disabled {
+			continue
+		}
+		v := c.Jail[k]
+		if v.Filter != "" {
+			f, err := lookupFilter(v.Filter)
+			if err != nil {
+				return fmt.Errorf("%s: %w", k, err)
 			}
+			v = f.apply(v)
 		}
-		c.re = append(c.re, regexps{re, index})
-		if index < 0 {
-			return fmt.Errorf("missing named group `IP` in regexp %q", v)
+		j, err := c.newJail(k, v, global)
+		if err != nil {
+			return fmt.Errorf("%s: %w", k, err)
 		}
+		c.jails = append(c.jails, j)
 	}
-
-	for _, v := range c.RegExps.TestRE {
-		found := false
-		for _, re := range c.re {
-			if res := re.RE.FindStringSubmatch(v); len(res) > 0 {
-				if ip := parseCIDR(res[re.IPIndex], cfg.Settings.Verbose); ip == nil {
-					return fmt.Errorf("unable to parse IP from test-re %q", res[re.IPIndex])
-				}
-				found = true
-				break
-			}
+	if len(c.jails) == 0 {
+		return fmt.Errorf("need at least one valid regexp")
+	}
+	// A global test-ignore has to be ignored by every jail matching it.
+	for _, s := range c.RegExps.TestIgnore {
+		ms := c.match(lineMessage(s))
+		if len(ms) == 0 {
+			return fmt.Errorf("test-ignore failed to match any re %q", s)
 		}
-		if !found {
-			return fmt.Errorf("test-re failed to match any re %q", v)
+		for _, m := range ms {
+			if m.Ignore == nil {
+				return fmt.Errorf("%s: test-ignore failed to match any ignore-re %q", m.Jail.name, s)
+			}
 		}
 	}
-
 	return nil
 }
 
-func newConfigString(data string, port uint16, blocktime Duration, autodelete, verbose bool) (Config, error) {
+func newConfigString(data string, port, tcpport uint16, blocktime Duration, autodelete, verbose bool) (Config, error) {
 	var cfg Config
 	err := gcfg.ReadStringInto(&cfg, data)
 	if err != nil {
 		return Config{}, err
 	}
-	cfg.mergeFlags(port, blocktime, autodelete, verbose)
+	cfg.mergeFlags(port, tcpport, blocktime, autodelete, verbose)
 	if err = cfg.setupDefaults(); err != nil {
 		return Config{}, err
 	}
-	if err = cfg.setupREs(); err != nil {
+	if err = cfg.setupJails(); err != nil {
 		return Config{}, err
 	}
 	return cfg, nil
 }
 
-func newConfigFile(path string, port uint16, blocktime Duration, autodelete, verbose bool) (Config, error) {
+func newConfigFile(path string, port, tcpport uint16, blocktime Duration, autodelete, verbose bool) (Config, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return Config{}, err
 	}
-	return newConfigString(string(data), port, blocktime, autodelete, verbose)
+	return newConfigString(string(data), port, tcpport, blocktime, autodelete, verbose)
 }
@@ -20,25 +20,30 @@ func TestFlagOverride(t *testing.T) {
 		ExpectAutoDelete bool
 		ExpectVerbose    bool
 		ExpectPort       uint16
+		ExpectTCPPort    uint16
 	}{
-		{"NoFlags", "", 0, false, false, 0},
-		{"Blocktime", "-blocktime=8h", Duration(8 * time.Hour), false, false, 0},
-		{"Autodelete", "-autodelete", 0, true, false, 0},
-		{"Verbose", "-verbose", 0, false, true, 0},
-		{"Port", "-port=1234", 0, false, false, 1234},
-		{"AllFlags", "-blocktime=16h -autodelete -verbose -port=5678", Duration(16 * time.Hour), true, true, 5678}}
+		{"NoFlags", "", 0, false, false, 0, 0},
+		{"Blocktime", "-blocktime=8h", Duration(8 * time.Hour), false, false, 0, 0},
+		{"Autodelete", "-autodelete", 0, true, false, 0, 0},
+		{"Verbose", "-verbose", 0, false, true, 0, 0},
+		{"Port", "-port=1234", 0, false, false, 1234, 0},
+		{"TCPPort", "-tcpport=1234", 0, false, false, 0, 1234},
+		{"AllFlags", "-blocktime=16h -autodelete -verbose -port=5678 -tcpport=5679", Duration(16 * time.Hour), true, true, 5678, 5679}}
 
 	for _, d := range data {
 		_ = setFlags(strings.Split(d.Override, " ")...)
 		t.Run(d.Name, func(t *testing.T) {
 			var cfg Config
-			cfg.mergeFlags(uint16(*port), Duration(*blocktime), *autodelete, *verbose)
+			cfg.mergeFlags(uint16(*port), uint16(*tcpport), Duration(*blocktime), *autodelete, *verbose)
 			if cfg.Settings.BlockTime != d.ExpectBlockTime {
 				t.Errorf("settings.blocktime: expected %v, actual %v", d.ExpectBlockTime, cfg.Settings.BlockTime)
 			}
 			if cfg.Settings.Port != d.ExpectPort {
 				t.Errorf("settings.port: expected %v, actual %v", d.ExpectPort, cfg.Settings.Port)
 			}
+			if cfg.Settings.TCPPort != d.ExpectTCPPort {
+				t.Errorf("settings.tcpport: expected %v, actual %v", d.ExpectTCPPort, cfg.Settings.TCPPort)
+			}
 			if cfg.Settings.AutoDelete != d.ExpectAutoDelete {
 				t.Errorf("settings.autodelete: expected %v, actual %v", d.ExpectAutoDelete, cfg.Settings.AutoDelete)
 			}
@@ -77,7 +82,7 @@ func TestReadConfig(t *testing.T) {
 				t.Fatal("One cannot have both err: and out: set")
 			}
 
-			cfg, err := newConfigString(yml.In, 0, Duration(0*time.Hour), false, false)
+			cfg, err := newConfigString(yml.In, 0, 0, Duration(0*time.Hour), false, false)
 			if len(yml.Out) != 0 {
 				if err != nil {
 					t.Fatal(err)
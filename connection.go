@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	ros "github.com/go-routeros/routeros/v3"
+)
+
+const (
+	// minBackoff and maxBackoff bound the time between reconnect attempts
+	// to a Mikrotik, doubling after every failed attempt.
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// errDegraded is returned for API calls to a Mikrotik we are not connected
+// to, or which is still being resynchronized after reconnecting.
+var errDegraded = errors.New("not connected")
+
+// isConnError reports whether err, as returned by the API, means the
+// connection itself is broken. Errors reported by the Mikrotik (!trap)
+// leave the connection usable.
+func isConnError(err error) bool {
+	var devErr *ros.DeviceError
+	return err != nil && !errors.As(err, &devErr)
+}
+
+// run executes an API command on the Mikrotik, giving up after 5 seconds.
+// A failing connection is closed and the Mikrotik marked degraded, so it
+// gets reconnected.
+func (mt *Mikrotik) run(ctx context.Context, args ...string) (*ros.Reply, error) {
+	client := mt.client.Load()
+	if client == nil {
+		return nil, errDegraded
+	}
+	rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	reply, err := client.RunArgsContext(rctx, args)
+	if isConnError(err) {
+		mt.fail(client, err)
+	}
+	return reply, err
+}
+
+// fail closes the broken client and marks the Mikrotik degraded, once per
+// client, waking up maintain to reconnect.
+func (mt *Mikrotik) fail(client *ros.Client, err error) {
+	if !mt.client.CompareAndSwap(client, nil) {
+		return
+	}
+	if mt.degraded.CompareAndSwap(false, true) {
+		log.Printf("%s: connection lost, degraded: %v", mt.Name, err)
+	}
+	_ = client.Close()
+	select {
+	case mt.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// Degraded reports whether the Mikrotik is down, or not yet resynchronized
+// after reconnecting. Changes for it are queued meanwhile.
+func (mt *Mikrotik) Degraded() bool {
+	return mt.degraded.Load()
+}
+
+// connect dials the Mikrotik, rereads its address lists from scratch and
+// applies the changes queued meanwhile. On success the Mikrotik is no
+// longer degraded.
+func (mt *Mikrotik) connect(ctx context.Context) error {
+	var (
+		client *ros.Client
+		err    error
+	)
+	dialctx, cancel := context.WithTimeout(ctx, time.Minute)
+	if mt.config.UseTLS {
+		client, err = ros.DialTLSContext(dialctx, mt.Address, mt.User, mt.Passwd, nil)
+	} else {
+		client, err = ros.DialContext(dialctx, mt.Address, mt.User, mt.Passwd)
+	}
+	cancel()
+	if err != nil {
+		return err
+	}
+	// Async mode pipelines concurrent commands over the connection, and
+	// is needed to follow changes.
+	client.Queue = 100
+	errc := client.Async()
+	go func() {
+		if err := <-errc; err != nil {
+			mt.fail(client, err)
+		}
+	}()
+	mt.client.Store(client)
+
+	mt.Lock()
+	mt.dynlist, mt.whitelist, mt.blacklist = nil, nil, nil
+	mt.Unlock()
+	if err := mt.populateBanlist(ctx, mt.config.Whitelist, mt.config.Blacklist); err != nil {
+		mt.fail(client, err)
+		return err
+	}
+	if err := mt.flushQueue(ctx); err != nil {
+		mt.fail(client, err)
+		return err
+	}
+	// Follow the changes made by others from now on.
+	go mt.listen(ctx, client, false)
+	go mt.listen(ctx, client, true)
+	if cfg.Settings.AutoDelete {
+		// The dynlist changed underneath the auto deleter.
+		select {
+		case mt.hasData <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// maintain reconnects the Mikrotik whenever it got degraded, with an
+// exponential backoff between failing attempts, until ctx is done.
+func (mt *Mikrotik) maintain(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-mt.reconnect:
+		}
+		if !mt.Degraded() {
+			// Stale wakeup from a failed attempt.
+			continue
+		}
+		for backoff := minBackoff; ; backoff = min(2*backoff, maxBackoff) {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			err := mt.connect(ctx)
+			if err == nil {
+				log.Printf("%s: reconnected, resynchronized %d dynamic entries", mt.Name, len(mt.GetIPs()))
+				break
+			}
+			log.Printf("%s: reconnect failed, retrying in %s: %v", mt.Name, min(2*backoff, maxBackoff), err)
+		}
+	}
+}
+
+// Close closes the connection to the Mikrotik, if any.
+func (mt *Mikrotik) Close() error {
+	client := mt.client.Swap(nil)
+	if client == nil {
+		return nil
+	}
+	if err := client.Close(); err != nil {
+		return fmt.Errorf("%s: %w", mt.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	ros "github.com/go-routeros/routeros/v3"
+)
+
+func TestIsConnError(t *testing.T) {
+	testdata := []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{&ros.DeviceError{}, false},
+		{fmt.Errorf("addip=%w", &ros.DeviceError{}), false},
+		{io.EOF, true},
+		{context.DeadlineExceeded, true},
+	}
+	for _, d := range testdata {
+		if got := isConnError(d.err); got != d.expect {
+			t.Errorf("isConnError(%v) = %t, expected %t", d.err, got, d.expect)
+		}
+	}
+}
+
+func TestUnreachableMikrotik(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	// Grab a free port and close it again, so nothing listens there.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	_ = l.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mt, closer, err := NewMikrotik(ctx, "MT-1", &ConfigMikrotik{Address: addr, User: "user", Passwd: "passwd", BanList: "blacklist"})
+	if err != nil {
+		t.Fatalf("NewMikrotik() = %v, expected a degraded Mikrotik", err)
+	}
+	defer func() { _ = closer(ctx) }()
+	if !mt.Degraded() {
+		t.Errorf("Degraded() = false, expected true")
+	}
+	_, ip, _ := net.ParseCIDR("192.0.2.1/32")
+	if err := mt.AddIP(ctx, "", *ip, Duration(time.Hour), ""); err != nil {
+		t.Errorf("AddIP() = %v, expected it to be queued", err)
+	}
+	if len(mt.queue.ops) != 1 {
+		t.Errorf("queue = %v, expected 1 entry", mt.queue.ops)
+	}
+	// Closing saves the queue for the next run.
+	if err := closer(ctx); err != nil {
+		t.Errorf("closer() = %v", err)
+	}
+	if _, err := os.Stat(statePath(queueFile("MT-1"))); err != nil {
+		t.Errorf("queue not saved on close: %v", err)
+	}
+
+	if _, _, err := NewMikrotik(ctx, "MT-2", &ConfigMikrotik{Address: addr, Whitelist: []string{"bogus"}}); err == nil {
+		t.Errorf("NewMikrotik() accepted a bogus whitelist entry")
+	}
+}
+
+func TestAutoDeleteDegraded(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	_, ip, _ := net.ParseCIDR("192.0.2.1/32")
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist", hasData: make(chan struct{}), dynlist: []BlackIP{
+		{Net: *ip, Dead: time.Now().Add(-time.Minute), ID: "*1"},
+	}}
+	mt.queue.file = queueFile(mt.Name)
+	mt.degraded.Store(true)
+	done := make(chan struct{})
+	go func() {
+		mt.autoDelete(context.Background())
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(mt.hasData)
+	<-done
+
+	// The expired entry is left for when the Mikrotik is back, instead
+	// of trying to remove it over and over again.
+	if len(mt.queue.ops) != 0 {
+		t.Errorf("queue = %v, expected nothing queued while degraded", mt.queue.ops)
+	}
+	if ips := mt.GetIPs(); len(ips) != 1 {
+		t.Errorf("GetIPs() = %v, expected the expired entry to be kept", ips)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// fieldRule matches a message on its structured fields rather than its
+// text, returning the fields as named groups, `IP` among them, or nil when
+// the message does not match.
+type fieldRule interface {
+	match(msg *message) map[string]string
+	String() string
+}
+
+// fieldCond is a condition on a field of a message. The value of the field
+// has to match the pattern for `=`, not match it for `!=`, or compare to
+// the number for `<`, `<=`, `>` and `>=`.
+type fieldCond struct {
+	field string
+	op    string
+	p     pattern
+	num   float64
+}
+
+// condSyntax splits a condition of the form `field op value`.
+var condSyntax = regexp.MustCompile(`^(\S+?)\s*(!=|<=|>=|=|<|>)\s*(.*)$`)
+
+// newFieldCond parses a condition on a field.
+func newFieldCond(s string) (fieldCond, error) {
+	res := condSyntax.FindStringSubmatch(s)
+	if res == nil {
+		return fieldCond{}, fmt.Errorf("bad condition %q", s)
+	}
+	fc := fieldCond{field: res[1], op: res[2]}
+	if fc.op == "=" || fc.op == "!=" {
+		p, err := newPattern(res[3])
+		if err != nil {
+			return fieldCond{}, err
+		}
+		fc.p = p
+		return fc, nil
+	}
+	num, err := strconv.ParseFloat(res[3], 64)
+	if err != nil {
+		return fieldCond{}, fmt.Errorf("%s needs a number in %q", fc.op, s)
+	}
+	fc.num = num
+	return fc, nil
+}
+
+// match reports whether the value of the field satisfies the condition.
+// A missing field only satisfies `!=`, a value which is not a number
+// fails any comparison.
+func (fc fieldCond) match(v string, ok bool) bool {
+	switch fc.op {
+	case "=":
+		return ok && fc.p.match(v)
+	case "!=":
+		return !ok || !fc.p.match(v)
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if !ok || err != nil {
+		return false
+	}
+	switch fc.op {
+	case "<":
+		return n < fc.num
+	case "<=":
+		return n <= fc.num
+	case ">":
+		return n > fc.num
+	}
+	return n >= fc.num
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// facilityNames are the names of the syslog facilities, indexed by
+	// their code.
+	facilityNames = []string{
+		"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+		"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+		"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+	}
+	// severityNames are the names of the syslog severities, indexed by
+	// their code.
+	severityNames = []string{
+		"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug",
+	}
+)
+
+// pattern matches a header field, either exactly, as a glob when it
+// contains any of "*?[" or as a regexp when it is enclosed in slashes.
+type pattern struct {
+	s    string
+	glob bool
+	re   *regexp.Regexp
+}
+
+// newPattern parses a header filter pattern.
+func newPattern(s string) (pattern, error) {
+	p := pattern{s: s}
+	switch {
+	case len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"):
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return p, err
+		}
+		p.re = re
+	case strings.ContainsAny(s, "*?["):
+		if _, err := path.Match(s, ""); err != nil {
+			return p, fmt.Errorf("bad glob %q: %w", s, err)
+		}
+		p.glob = true
+	}
+	return p, nil
+}
+
+// match reports whether v matches the pattern.
+func (p pattern) match(v string) bool {
+	switch {
+	case p.re != nil:
+		return p.re.MatchString(v)
+	case p.glob:
+		ok, _ := path.Match(p.s, v)
+		return ok
+	}
+	return p.s == v
+}
+
+// headerFilter limits a jail to messages with a header field matching any
+// of its patterns.
+type headerFilter struct {
+	field    string
+	patterns []pattern
+}
+
+// newHeaderFilter parses the patterns of a filter on the named field, nil
+// when there are none.
+func newHeaderFilter(field string, ss []string) (*headerFilter, error) {
+	if len(ss) == 0 {
+		return nil, nil
+	}
+	f := &headerFilter{field: field}
+	for _, s := range ss {
+		p, err := newPattern(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+		f.patterns = append(f.patterns, p)
+	}
+	return f, nil
+}
+
+// match reports whether msg passes the filter. Facilities and severities
+// match by either name or number. Messages lacking the field never pass.
+func (f *headerFilter) match(msg *message) bool {
+	var values []string
+	switch f.field {
+	case "hostname":
+		values = []string{msg.Hostname}
+	case "tag":
+		values = []string{msg.Tag}
+	case "facility":
+		values = codeValues(msg.Facility, facilityNames)
+	case "severity":
+		values = codeValues(msg.Severity, severityNames)
+	}
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		for _, p := range f.patterns {
+			if p.match(v) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// codeValues returns the number and name of a facility or severity code,
+// nothing when the code is unknown.
+func codeValues(code int, names []string) []string {
+	if code < 0 {
+		return nil
+	}
+	values := []string{strconv.Itoa(code)}
+	if code < len(names) {
+		values = append(values, names[code])
+	}
+	return values
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestHeaderFilter(t *testing.T) {
+	pbx, err := parseSyslog([]byte("<38>Oct 11 22:14:15 pbx-1 asterisk[123]: NOTICE something"), "192.0.2.1:514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		field    string
+		patterns []string
+		msg      *message
+		expect   bool
+	}{
+		{"hostname", []string{"pbx-1"}, pbx, true},
+		{"hostname", []string{"pbx"}, pbx, false},
+		{"hostname", []string{"www", "pbx-*"}, pbx, true},
+		{"hostname", []string{"/^PBX-\\d$/"}, pbx, false},
+		{"hostname", []string{"/^(?i)PBX-\\d$/"}, pbx, true},
+		{"tag", []string{"asterisk"}, pbx, true},
+		{"tag", []string{"sshd"}, pbx, false},
+		{"facility", []string{"auth"}, pbx, true},
+		{"facility", []string{"4"}, pbx, true},
+		{"facility", []string{"local*"}, pbx, false},
+		{"severity", []string{"info"}, pbx, true},
+		{"severity", []string{"/^(err|crit)$/"}, pbx, false},
+		// Lines from log files have no header.
+		{"hostname", []string{"*"}, textMessage("NOTICE something"), false},
+		{"facility", []string{"*"}, textMessage("NOTICE something"), false},
+	}
+	for _, d := range testdata {
+		f, err := newHeaderFilter(d.field, d.patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := f.match(d.msg); got != d.expect {
+			t.Errorf("%s %q: match(%+v) = %t, expected %t", d.field, d.patterns, d.msg, got, d.expect)
+		}
+	}
+
+	if _, err := newHeaderFilter("hostname", []string{"pbx-["}); err == nil {
+		t.Errorf("newHeaderFilter() accepted a bad glob")
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"time"
+)
+
+// defaultJail is the name of the jail formed by the regexps section.
+const defaultJail = "default"
+
+type regexps struct {
+	RE      *regexp.Regexp
+	IPIndex int
+}
+
+// ignoreRE is a regexp vetoing a ban. It is matched against the named
+// group Group of the match, or against the whole text when Group is empty.
+type ignoreRE struct {
+	Group string
+	RE    *regexp.Regexp
+}
+
+// ignoreSyntax splits an ignore-re of the form `GROUP =~ regexp`. Besides
+// the names of regexp groups, GROUP can be a structured data param or a
+// dotted JSON field path.
+var ignoreSyntax = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_.-]*)\s*=~\s*(.*)$`)
+
+// newIgnoreRE compiles an ignore-re, either a plain regexp matched against
+// the text or `GROUP =~ regexp` matched against a named group.
+func newIgnoreRE(s string) (ignoreRE, error) {
+	var ign ignoreRE
+	if res := ignoreSyntax.FindStringSubmatch(s); res != nil {
+		ign.Group, s = res[1], res[2]
+	}
+	re, err := regexp.Compile(s)
+	if err != nil {
+		return ign, err
+	}
+	ign.RE = re
+	return ign, nil
+}
+
+// String returns the ignore-re as written in the config.
+func (ign ignoreRE) String() string {
+	if ign.Group != "" {
+		return ign.Group + " =~ " + ign.RE.String()
+	}
+	return ign.RE.String()
+}
+
+// jail is the internal representation of a jail, a set of regexps and the
+// way their matches are banned. All settings are resolved against the
+// settings section already. An empty banlist means the banlist of the
+// Mikrotik, an empty mikrotik map means the jail applies to all of them.
+// A local jail only bans on the Mikrotik which sent the message.
+type jail struct {
+	name      string
+	re        []regexps
+	fields    []fieldRule
+	ignore    []ignoreRE
+	filters   []*headerFilter
+	blocktime Duration
+	maxretry  int
+	banlist   string
+	mikrotik  map[string]bool
+	local     bool
+	hits      *hitCounter
+}
+
+// match is the outcome of matching a text against the regexps of a jail.
+// Index is the index of the first rule matching, Groups holds the values
+// of all its named groups and IP the parsed `IP` group widened to the ban
+// prefix, nil when unparsable. Ignore is the ignore-re vetoing the ban,
+// nil when there is none.
+type match struct {
+	Jail   *jail
+	Index  int
+	Groups map[string]string
+	IP     *net.IPNet
+	Ignore *ignoreRE
+}
+
+// newJail compiles the regexps of a jail and checks them against the
+// test-re and test-ignore entries. The ignore regexps are those of the
+// jail followed by the global ones.
+func (c *Config) newJail(name string, v *ConfigJail, global []ignoreRE) (*jail, error) {
+	j := &jail{
+		name:      name,
+		blocktime: v.BlockTime,
+		maxretry:  v.MaxRetry,
+		banlist:   v.BanList,
+		local:     v.Local,
+	}
+	if j.blocktime == 0 {
+		j.blocktime = c.Settings.BlockTime
+	}
+	if j.maxretry == 0 {
+		j.maxretry = c.Settings.MaxRetry
+	}
+	if len(v.Mikrotik) != 0 {
+		j.mikrotik = make(map[string]bool)
+		for _, k := range v.Mikrotik {
+			j.mikrotik[k] = true
+		}
+	}
+	// Only keep track of hits when more than one is needed for a ban.
+	if j.maxretry > 1 {
+		findtime := time.Duration(v.FindTime)
+		if findtime == 0 {
+			findtime = time.Duration(c.Settings.FindTime)
+		}
+		if findtime == 0 {
+			findtime = 10 * time.Minute
+		}
+		maxtracked := c.Settings.MaxTracked
+		if maxtracked == 0 {
+			maxtracked = 100000
+		}
+		j.hits = newHitCounter(j.maxretry, findtime, maxtracked)
+	}
+
+	if len(v.RE) == 0 && v.SDIP == "" && v.JSONIP == "" {
+		return nil, fmt.Errorf("need at least one valid regexp")
+	}
+	for _, s := range v.RE {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return nil, err
+		}
+		index := -1
+		for i, val := range re.SubexpNames() {
+			if val == "IP" {
+				if index >= 0 {
+					return nil, fmt.Errorf("multiple named groups `IP` in regexp %q", s)
+				}
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("missing named group `IP` in regexp %q", s)
+		}
+		j.re = append(j.re, regexps{re, index})
+	}
+	if v.SDIP != "" {
+		r, err := newSDRule(v.SDIP, v.SDMatch)
+		if err != nil {
+			return nil, err
+		}
+		j.fields = append(j.fields, r)
+	} else if len(v.SDMatch) != 0 {
+		return nil, fmt.Errorf("sd-match requires sd-ip")
+	}
+	if v.JSONIP != "" {
+		r, err := newJSONRule(v.JSONIP, v.JSONMatch)
+		if err != nil {
+			return nil, err
+		}
+		j.fields = append(j.fields, r)
+	} else if len(v.JSONMatch) != 0 {
+		return nil, fmt.Errorf("json-match requires json-ip")
+	}
+	for _, s := range v.IgnoreRE {
+		ign, err := newIgnoreRE(s)
+		if err != nil {
+			return nil, err
+		}
+		j.ignore = append(j.ignore, ign)
+	}
+	j.ignore = append(j.ignore, global...)
+	for _, f := range []struct {
+		field    string
+		patterns []string
+	}{
+		{"hostname", v.Hostname},
+		{"tag", v.Tag},
+		{"facility", v.Facility},
+		{"severity", v.Severity},
+	} {
+		hf, err := newHeaderFilter(f.field, f.patterns)
+		if err != nil {
+			return nil, err
+		}
+		if hf != nil {
+			j.filters = append(j.filters, hf)
+		}
+	}
+
+	for _, s := range v.TestRE {
+		m := j.match(lineMessage(s), c.Settings.Verbose)
+		if m == nil {
+			return nil, fmt.Errorf("test-re failed to match any re %q", s)
+		}
+		if m.IP == nil {
+			return nil, fmt.Errorf("unable to parse IP from test-re %q", m.Groups["IP"])
+		}
+		if m.Ignore != nil {
+			return nil, fmt.Errorf("test-re ignored by ignore-re %q: %q", m.Ignore.String(), s)
+		}
+	}
+	for _, s := range v.TestIgnore {
+		m := j.match(lineMessage(s), c.Settings.Verbose)
+		if m == nil {
+			return nil, fmt.Errorf("test-ignore failed to match any re %q", s)
+		}
+		if m.Ignore == nil {
+			return nil, fmt.Errorf("test-ignore failed to match any ignore-re %q", s)
+		}
+	}
+	return j, nil
+}
+
+// appliesTo reports whether the jail bans on the named Mikrotik.
+func (j *jail) appliesTo(name string) bool {
+	return j.mikrotik == nil || j.mikrotik[name]
+}
+
+// jailOf returns the jail named by the rule of an entry comment, nil when
+// there is none, like for aggregates and entries added by hand.
+func (c *Config) jailOf(rule string) *jail {
+	for _, j := range c.jails {
+		if commentName(j.name) == commentName(rule) {
+			return j
+		}
+	}
+	return nil
+}
+
+// rules returns the number of rules of the jail, the regexps followed by
+// the field rules.
+func (j *jail) rules() int {
+	return len(j.re) + len(j.fields)
+}
+
+// rule describes the rule with index i.
+func (j *jail) rule(i int) string {
+	if i < len(j.re) {
+		return j.re[i].RE.String()
+	}
+	return j.fields[i-len(j.re)].String()
+}
+
+// match returns the outcome of matching msg against the header filters and
+// rules of the jail, or nil when it did not match. A match vetoed by an
+// ignore-re is still returned, with Ignore set.
+func (j *jail) match(msg *message, verbose bool) *match {
+	for _, f := range j.filters {
+		if !f.match(msg) {
+			return nil
+		}
+	}
+	text := msg.Text
+	m := &match{Jail: j}
+	for i, re := range j.re {
+		res := re.RE.FindStringSubmatch(text)
+		if len(res) == 0 {
+			continue
+		}
+		m.Index, m.Groups = i, make(map[string]string)
+		for k, name := range re.RE.SubexpNames() {
+			if name != "" {
+				m.Groups[name] = res[k]
+			}
+		}
+		break
+	}
+	for i := 0; m.Groups == nil && i < len(j.fields); i++ {
+		m.Index, m.Groups = len(j.re)+i, j.fields[i].match(msg)
+	}
+	if m.Groups == nil {
+		return nil
+	}
+
+	if m.IP = parseCIDR(m.Groups["IP"], verbose); m.IP != nil {
+		m.IP = banPrefix(m.IP)
+	}
+	for k, ign := range j.ignore {
+		if ign.Group == "" && ign.RE.MatchString(text) {
+			m.Ignore = &j.ignore[k]
+			break
+		}
+		if v, ok := m.Groups[ign.Group]; ok && ign.Group != "" && ign.RE.MatchString(v) {
+			m.Ignore = &j.ignore[k]
+			break
+		}
+	}
+	return m
+}
+
+// match returns the outcome of matching msg against every jail. Jails are
+// independent of each other, so a single message can match several.
+func (c *Config) match(msg *message) []*match {
+	var ms []*match
+	for _, j := range c.jails {
+		if m := j.match(msg, c.Settings.Verbose); m != nil {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// flattenJSON adds the scalar values of v to fields, indexed by their
+// dotted path below prefix. Array elements are indexed by their position.
+func flattenJSON(prefix string, v interface{}, fields map[string]string) {
+	key := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			flattenJSON(key(k), e, fields)
+		}
+	case []interface{}:
+		for i, e := range v {
+			flattenJSON(key(strconv.Itoa(i)), e, fields)
+		}
+	case string:
+		fields[prefix] = v
+	case json.Number:
+		fields[prefix] = v.String()
+	case bool:
+		fields[prefix] = strconv.FormatBool(v)
+	}
+}
+
+// jsonFields returns the fields of the JSON object in the text of msg,
+// which may be preceded by anything not containing a '{'. The result is
+// nil when the text holds no JSON object, and is kept for the other jails.
+func (msg *message) jsonFields() map[string]string {
+	if msg.json != nil {
+		return *msg.json
+	}
+	var fields map[string]string
+	if i := strings.IndexByte(msg.Text, '{'); i >= 0 {
+		dec := json.NewDecoder(strings.NewReader(msg.Text[i:]))
+		dec.UseNumber()
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err == nil {
+			fields = make(map[string]string)
+			flattenJSON("", v, fields)
+		}
+	}
+	msg.json = &fields
+	return fields
+}
+
+// jsonRule takes the IP from a field of a JSON message, given the other
+// conditions on its fields hold.
+type jsonRule struct {
+	ip    string
+	conds []fieldCond
+}
+
+// newJSONRule parses a json-ip field path and its json-match conditions.
+func newJSONRule(ip string, conds []string) (*jsonRule, error) {
+	r := &jsonRule{ip: ip}
+	for _, s := range conds {
+		fc, err := newFieldCond(s)
+		if err != nil {
+			return nil, fmt.Errorf("json-match: %w", err)
+		}
+		r.conds = append(r.conds, fc)
+	}
+	return r, nil
+}
+
+// match returns all fields of the message, with the IP as `IP`, when all
+// conditions hold.
+func (r *jsonRule) match(msg *message) map[string]string {
+	fields := msg.jsonFields()
+	ip, ok := fields[r.ip]
+	if !ok {
+		return nil
+	}
+	for _, fc := range r.conds {
+		v, ok := fields[fc.field]
+		if !fc.match(v, ok) {
+			return nil
+		}
+	}
+	groups := make(map[string]string, len(fields)+1)
+	for k, v := range fields {
+		groups[k] = v
+	}
+	groups["IP"] = ip
+	return groups
+}
+
+// String describes the rule.
+func (r *jsonRule) String() string {
+	return "json-ip " + r.ip
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestJSONRule(t *testing.T) {
+	r, err := newJSONRule("request.remote_ip", []string{"status >= 401", "status != 404", "request.method = /^(GET|POST)$/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		text   string
+		expect bool
+	}{
+		{`{"request":{"remote_ip":"1.2.3.4","method":"GET"},"status":401}`, true},
+		{`nginx: {"request":{"remote_ip":"1.2.3.4","method":"POST"},"status":403.0}`, true},
+		{`{"request":{"remote_ip":"1.2.3.4","method":"GET"},"status":200}`, false},
+		{`{"request":{"remote_ip":"1.2.3.4","method":"GET"},"status":404}`, false},
+		{`{"request":{"remote_ip":"1.2.3.4","method":"PUT"},"status":401}`, false},
+		{`{"request":{"remote_ip":"1.2.3.4","method":"GET"},"status":"bogus"}`, false},
+		{`{"request":{"method":"GET"},"status":401}`, false},
+		{`{"request":{"remote_ip":"1.2.3.4"`, false},
+		{`not json at all`, false},
+	}
+	for _, d := range testdata {
+		groups := r.match(textMessage(d.text))
+		if (groups != nil) != d.expect {
+			t.Errorf("match(%s) = %v, expected %t", d.text, groups, d.expect)
+		}
+		if groups != nil && (groups["IP"] != "1.2.3.4" || groups["request.method"] == "") {
+			t.Errorf("match(%s) = %v, expected IP and request.method", d.text, groups)
+		}
+	}
+
+	for _, s := range []string{"status >= many", "status"} {
+		if _, err := newJSONRule("ip", []string{s}); err == nil {
+			t.Errorf("newJSONRule() accepted condition %q", s)
+		}
+	}
+}
+
+func TestFlattenJSON(t *testing.T) {
+	msg := textMessage(`{"a":{"b":[1,{"c":true}],"d":null},"e":"f"}`)
+	fields := msg.jsonFields()
+	expect := map[string]string{"a.b.0": "1", "a.b.1.c": "true", "e": "f"}
+	if len(fields) != len(expect) {
+		t.Errorf("jsonFields() = %v, expected %v", fields, expect)
+	}
+	for k, v := range expect {
+		if fields[k] != v {
+			t.Errorf("jsonFields()[%s] = %q, expected %q", k, fields[k], v)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// libraryFilter is a filter of the built-in library, a jail without any
+// ban settings. Filters are versioned, so a config can pin the version it
+// was written against; changed filters get a new version instead of
+// changing an existing one.
+type libraryFilter struct {
+	Name    string
+	Version int
+	Jail    ConfigJail
+}
+
+// library holds the built-in filters, to be enabled with `filter = name`
+// or `filter = name@version` in a jail section.
+var library = []libraryFilter{
+	{"sshd", 1, ConfigJail{
+		RE: []string{
+			`Failed (?:password|publickey|keyboard-interactive/pam) for (?:invalid user )?(?P<USER>\S*) from (?P<IP>[0-9a-fA-F.:]+) port \d+`,
+			`Invalid user (?P<USER>\S*) from (?P<IP>[0-9a-fA-F.:]+)(?: port \d+)?$`,
+			`Connection (?:closed|reset) by (?:authenticating|invalid) user (?P<USER>\S*) (?P<IP>[0-9a-fA-F.:]+) port \d+ \[preauth\]`,
+			`maximum authentication attempts exceeded for (?:invalid user )?(?P<USER>\S*) from (?P<IP>[0-9a-fA-F.:]+) port \d+`,
+			`Unable to negotiate with (?P<IP>[0-9a-fA-F.:]+) port \d+: no matching`,
+		},
+		TestRE: []string{
+			`Failed password for root from 192.0.2.1 port 8962 ssh2`,
+			`Failed password for invalid user admin from 2001:db8::1 port 8962 ssh2`,
+			`Invalid user oracle from 192.0.2.1 port 50312`,
+			`Connection closed by authenticating user root 192.0.2.1 port 50312 [preauth]`,
+			`error: maximum authentication attempts exceeded for invalid user pi from 192.0.2.1 port 50312 ssh2 [preauth]`,
+			`Unable to negotiate with 192.0.2.1 port 50312: no matching key exchange method found.`,
+		},
+	}},
+	{"postfix", 1, ConfigJail{
+		RE: []string{
+			`warning: [-._\w]+\[(?P<IP>[0-9a-fA-F.:]+)\]: SASL (?:LOGIN|PLAIN|CRAM-MD5|DIGEST-MD5) authentication failed`,
+			`NOQUEUE: reject: RCPT from [-._\w]+\[(?P<IP>[0-9a-fA-F.:]+)\]: 554 5\.7\.1 .*Relay access denied`,
+		},
+		TestRE: []string{
+			`warning: unknown[192.0.2.1]: SASL LOGIN authentication failed: UGFzc3dvcmQ6`,
+			`NOQUEUE: reject: RCPT from unknown[192.0.2.1]: 554 5.7.1 <spam@example.com>: Relay access denied; from=<a@example.org> to=<spam@example.com> proto=ESMTP helo=<x>`,
+		},
+	}},
+	{"dovecot", 1, ConfigJail{
+		RE: []string{
+			`(?:imap|pop3|submission|managesieve)-login: (?:Info: )?(?:Aborted login|Disconnected|Login aborted).*\(auth failed, \d+ attempts.*\): user=<(?P<USER>[^>]*)>.*, rip=(?P<IP>[0-9a-fA-F.:]+)`,
+		},
+		TestRE: []string{
+			`imap-login: Disconnected (auth failed, 1 attempts in 2 secs): user=<admin>, method=PLAIN, rip=192.0.2.1, lip=198.51.100.1, TLS, session=<abc>`,
+			`pop3-login: Info: Aborted login (auth failed, 3 attempts in 10 secs): user=<info>, method=LOGIN, rip=2001:db8::1, lip=2001:db8::2, session=<abc>`,
+		},
+	}},
+	{"asterisk", 1, ConfigJail{
+		RE: []string{
+			`Registration from '[^']*' failed for '\[?(?P<IP>[0-9a-fA-F.:]+?)\]?(?::\d+)?' - (?:Wrong password|No matching peer found|Username/auth name mismatch|Device does not match ACL|Peer is not supposed to register)`,
+			`SecurityEvent="(?:InvalidPassword|ChallengeResponseFailed|FailedACL|InvalidAccountID)".*RemoteAddress="IPV[46]/(?:UDP|TCP|TLS|WS|WSS)/(?P<IP>[0-9a-fA-F.:]+)/\d+"`,
+		},
+		TestRE: []string{
+			`NOTICE[1234]: chan_sip.c:28926 handle_request_register: Registration from '"100" <sip:100@198.51.100.1>' failed for '192.0.2.1:5060' - Wrong password`,
+			`NOTICE[1234]: chan_sip.c:28926 handle_request_register: Registration from '<sip:100@198.51.100.1>' failed for '[2001:db8::1]:5060' - No matching peer found`,
+			`SECURITY[1234] res_security_log.c: SecurityEvent="InvalidPassword",EventTV="2024-01-01T00:00:00.000+0000",Severity="Error",Service="PJSIP",EventVersion="2",AccountID="100",SessionID="abc",LocalAddress="IPV4/UDP/198.51.100.1/5060",RemoteAddress="IPV4/UDP/192.0.2.1/5060",Challenge="1",ReceivedChallenge="1",ReceivedHash="abc"`,
+		},
+	}},
+	{"nginx-auth", 1, ConfigJail{
+		RE: []string{
+			`user "(?P<USER>[^"]*)"(?:: password mismatch| was not found in "[^"]*"), client: (?P<IP>[0-9a-fA-F.:]+),`,
+			`no user/password was provided for basic authentication, client: (?P<IP>[0-9a-fA-F.:]+),`,
+		},
+		TestRE: []string{
+			`2024/01/01 00:00:00 [error] 123#123: *1 user "admin": password mismatch, client: 192.0.2.1, server: example.com, request: "GET / HTTP/1.1", host: "example.com"`,
+			`2024/01/01 00:00:00 [error] 123#123: *1 user "admin" was not found in "/etc/nginx/.htpasswd", client: 2001:db8::1, server: example.com, request: "GET / HTTP/1.1", host: "example.com"`,
+			`2024/01/01 00:00:00 [error] 123#123: *1 no user/password was provided for basic authentication, client: 192.0.2.1, server: example.com, request: "GET / HTTP/1.1", host: "example.com"`,
+		},
+	}},
+	{"routeros", 1, ConfigJail{
+		RE: []string{
+			// "login" may have been taken for the tag of the message.
+			`failure for user (?P<USER>.*) from (?P<IP>[0-9a-fA-F.:]+) via (?P<SERVICE>\S+)`,
+		},
+		TestRE: []string{
+			`login failure for user admin from 192.0.2.1 via ssh`,
+			`<86>system,error,critical login failure for user admin from 192.0.2.1 via winbox`,
+			`<86>Jan  1 00:00:00 MikroTik login failure for user fwban from 192.0.2.1 via api`,
+			`login failure for user admin user from 2001:db8::1 via winbox`,
+		},
+	}},
+}
+
+// lookupFilter returns the library filter named by s, either a bare name
+// for its latest version or name@version for a specific one.
+func lookupFilter(s string) (*libraryFilter, error) {
+	name, version := s, 0
+	if i := strings.LastIndex(s, "@"); i >= 0 {
+		v, err := strconv.Atoi(s[i+1:])
+		if err != nil || v < 1 {
+			return nil, fmt.Errorf("bad filter version in %q", s)
+		}
+		name, version = s[:i], v
+	}
+	var found *libraryFilter
+	for i, f := range library {
+		if f.Name != name || (version != 0 && f.Version != version) {
+			continue
+		}
+		if found == nil || f.Version > found.Version {
+			found = &library[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("unknown filter %q", s)
+	}
+	return found, nil
+}
+
+// apply returns the jail v based on the filter. Regexps set in the jail
+// replace those of the filter, together with its test-re entries. The
+// ignore-re and test-ignore entries of both are combined and all other
+// settings are taken from the jail.
+func (f *libraryFilter) apply(v *ConfigJail) *ConfigJail {
+	j := *v
+	if len(j.RE) == 0 && j.SDIP == "" && j.JSONIP == "" {
+		j.RE = f.Jail.RE
+		j.TestRE = append(append([]string(nil), f.Jail.TestRE...), v.TestRE...)
+	}
+	j.IgnoreRE = append(append([]string(nil), f.Jail.IgnoreRE...), v.IgnoreRE...)
+	j.TestIgnore = append(append([]string(nil), f.Jail.TestIgnore...), v.TestIgnore...)
+	return &j
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestLibrary(t *testing.T) {
+	var c Config
+	seen := make(map[string]bool)
+	for _, f := range library {
+		name := fmt.Sprintf("%s@%d", f.Name, f.Version)
+		t.Run(name, func(t *testing.T) {
+			if seen[name] {
+				t.Fatalf("duplicate filter %s", name)
+			}
+			seen[name] = true
+			if len(f.Jail.TestRE) < len(f.Jail.RE) {
+				t.Errorf("expected at least one test-re per re")
+			}
+			// newJail checks every test-re against the regexps.
+			j, err := c.newJail(f.Name, &f.Jail, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			used := make([]bool, len(j.re))
+			for _, s := range f.Jail.TestRE {
+				used[j.match(textMessage(s), false).Index] = true
+			}
+			for i, ok := range used {
+				if !ok {
+					t.Errorf("re #%d is not exercised by any test-re", i)
+				}
+			}
+		})
+	}
+}
+
+func TestLookupFilter(t *testing.T) {
+	library = append(library, libraryFilter{"sshd", 1000, library[0].Jail})
+	defer func() { library = library[:len(library)-1] }()
+
+	testdata := []struct {
+		name    string
+		version int
+		ok      bool
+	}{
+		{"sshd", 1000, true},
+		{"sshd@1", 1, true},
+		{"sshd@1000", 1000, true},
+		{"sshd@999", 0, false},
+		{"sshd@latest", 0, false},
+		{"telnetd", 0, false},
+	}
+	for _, d := range testdata {
+		f, err := lookupFilter(d.name)
+		if (err == nil) != d.ok {
+			t.Errorf("lookupFilter(%s) error = %v, expected ok %t", d.name, err, d.ok)
+			continue
+		}
+		if d.ok && f.Version != d.version {
+			t.Errorf("lookupFilter(%s) = version %d, expected %d", d.name, f.Version, d.version)
+		}
+	}
+}
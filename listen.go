@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	ros "github.com/go-routeros/routeros/v3"
+)
+
+// change is an address list entry added or removed by hand on a Mikrotik,
+// to be done on the other Mikrotiks as well.
+type change struct {
+	mt      *Mikrotik
+	ip      BlackIP
+	comment string
+	removed bool
+}
+
+// changes carries the changes seen by the listeners to propagate.
+var changes = make(chan change, 1024)
+
+// familyID returns the key of an entry ID, which is only unique within the
+// IPv4 or IPv6 address lists.
+func familyID(v6 bool, id string) string {
+	if v6 {
+		return "6 " + id
+	}
+	return "4 " + id
+}
+
+// markOwn marks the keys as being changed by us, so the listeners do not
+// mistake them for changes made by hand. Additions are keyed by list and
+// prefix, as their ID is not known yet, removals by familyID.
+func (mt *Mikrotik) markOwn(keys []string, removal bool) {
+	mt.Lock()
+	defer mt.Unlock()
+	set := &mt.adding
+	if removal {
+		set = &mt.removing
+	}
+	if *set == nil {
+		*set = make(map[string]int)
+	}
+	for _, k := range keys {
+		(*set)[k]++
+	}
+}
+
+// unmarkOwn undoes markOwn.
+func (mt *Mikrotik) unmarkOwn(keys []string, removal bool) {
+	mt.Lock()
+	defer mt.Unlock()
+	set := mt.adding
+	if removal {
+		set = mt.removing
+	}
+	for _, k := range keys {
+		if set[k]--; set[k] <= 0 {
+			delete(set, k)
+		}
+	}
+}
+
+// listen follows the changes to the address lists of one family, until
+// the connection breaks. Changes we did not make ourselves are tracked in
+// the dynlist and handed to propagate.
+func (mt *Mikrotik) listen(ctx context.Context, client *ros.Client, v6 bool) {
+	cmd := "/ip/firewall/address-list/listen"
+	if v6 {
+		cmd = "/ipv6/firewall/address-list/listen"
+	}
+	lctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		// Canceling breaks the connection, so only do so once it is gone.
+		if mt.client.Load() != client {
+			cancel()
+		}
+	}()
+	l, err := client.ListenArgsContext(lctx, []string{cmd})
+	if err != nil {
+		log.Printf("%s: unable to follow changes, %s: %v", mt.Name, cmd, err)
+		return
+	}
+	for sen := range l.Chan() {
+		mt.tracked(sen.Map, v6)
+	}
+	if l.Err() != nil && !isConnError(l.Err()) {
+		log.Printf("%s: stopped following changes, %s: %v", mt.Name, cmd, l.Err())
+	}
+}
+
+// tracked handles a change reported by a listener. Removals of entries
+// which did not expire are unbans, additions with a timeout to a managed
+// list are bans. Static entries are left alone, those belong in the
+// blacklist setting.
+func (mt *Mikrotik) tracked(m map[string]string, v6 bool) {
+	id := m[".id"]
+	mt.Lock()
+	defer mt.Unlock()
+	if dead := m[".dead"]; dead == "true" || dead == "yes" {
+		if mt.removing[familyID(v6, id)] != 0 {
+			return
+		}
+		for i, v := range mt.dynlist {
+			if v.ID != id || (v.Net.IP.To4() == nil) != v6 {
+				continue
+			}
+			mt.dynlist = append(mt.dynlist[:i:i], mt.dynlist[i+1:]...)
+			if time.Until(v.Dead) > 2*time.Second {
+				log.Printf("%s: %s was removed by hand, unbanning it everywhere", mt.Name, v.Net.String())
+				mt.propagate(change{mt: mt, ip: v, removed: true})
+			}
+			return
+		}
+		return
+	}
+
+	list := m["list"]
+	if !mt.manages(list) || m["dynamic"] != "true" {
+		return
+	}
+	if list == mt.banlist {
+		list = ""
+	}
+	ip := parseCIDR(m["address"], cfg.Settings.Verbose)
+	if ip == nil {
+		return
+	}
+	if mt.adding[list+" "+ip.String()] != 0 {
+		return
+	}
+	for _, v := range mt.dynlist {
+		if v.ID == id && (v.Net.IP.To4() == nil) == v6 {
+			// Known already, like an update of its comment.
+			return
+		}
+	}
+	v := BlackIP{*ip, mt.toDuration(m["list"], m), id, list, parseComment(m["comment"])}
+	mt.dynlist = append(mt.dynlist, v)
+	sort.Sort(ByAge(mt.dynlist))
+	if cfg.Settings.AutoDelete {
+		select {
+		case mt.hasData <- struct{}{}:
+		default:
+		}
+	}
+	log.Printf("%s: %s was added by hand, banning it everywhere", mt.Name, ip.String())
+	mt.propagate(change{mt: mt, ip: v, comment: newComment("manual", time.Now(), 1).String()})
+}
+
+// propagate hands c to propagateChanges, without blocking the listener.
+func (mt *Mikrotik) propagate(c change) {
+	select {
+	case changes <- c:
+	default:
+		log.Printf("%s: too many changes, not propagating %s", mt.Name, c.ip.Net.String())
+	}
+}
+
+// propagateChanges applies the changes made by hand on one Mikrotik to the
+// others managing the same address list, until ctx is done.
+func propagateChanges(ctx context.Context, mts []*Mikrotik) {
+	for {
+		var c change
+		select {
+		case <-ctx.Done():
+			return
+		case c = <-changes:
+		}
+		var names []string
+		for _, mt := range mts {
+			if c.ip.List == "" || mt.manages(c.ip.List) {
+				names = append(names, mt.Name)
+			}
+		}
+		if c.removed {
+			bans.unban(c.ip.List, c.ip.Net, "removed by hand on "+c.mt.Name)
+		} else {
+			bans.record(c.ip.List, c.ip.Net, c.ip.Dead, "manual", "", "added by hand on "+c.mt.Name, c.mt.Name, names)
+			bans.setStatus(c.ip.List, c.ip.Net, c.mt.Name, "banned")
+		}
+		for _, mt := range mts {
+			if mt == c.mt || (c.ip.List != "" && !mt.manages(c.ip.List)) {
+				continue
+			}
+			if !c.removed {
+				if d := time.Until(c.ip.Dead); d >= time.Second {
+					mt.Ban(c.ip.List, c.ip.Net, Duration(d.Truncate(time.Second)), c.comment)
+				}
+				continue
+			}
+			for _, v := range mt.GetIPs() {
+				if v.List != c.ip.List || v.Net.String() != c.ip.Net.String() {
+					continue
+				}
+				go func() {
+					if err := mt.DelIP(ctx, v); err != nil && !strings.Contains(err.Error(), "no such item") {
+						log.Printf("%s: %v", mt.Name, err)
+					}
+				}()
+			}
+		}
+	}
+}
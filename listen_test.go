@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracked(t *testing.T) {
+	defer func() { cfg = Config{} }()
+	next := func() *change {
+		select {
+		case c := <-changes:
+			return &c
+		default:
+			return nil
+		}
+	}
+	_, ip, _ := net.ParseCIDR("192.0.2.9/32")
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist", lists: []string{"voip"}, dynlist: []BlackIP{
+		{*ip, time.Now().Add(time.Hour), "*9", "", nil},
+		{*ip, time.Now(), "*a", "voip", nil},
+	}}
+
+	// Our own addition in flight.
+	mt.markOwn([]string{" 192.0.2.1/32"}, false)
+	mt.tracked(map[string]string{".id": "*1", "list": "blacklist", "address": "192.0.2.1", "dynamic": "true", "timeout": "1h"}, false)
+	mt.unmarkOwn([]string{" 192.0.2.1/32"}, false)
+	if c := next(); c != nil || len(mt.dynlist) != 2 {
+		t.Errorf("tracked() = %v, %v for our own addition", c, mt.dynlist)
+	}
+	// Static entries and unmanaged lists are left alone.
+	mt.tracked(map[string]string{".id": "*2", "list": "blacklist", "address": "192.0.2.2", "dynamic": "false"}, false)
+	mt.tracked(map[string]string{".id": "*3", "list": "other", "address": "192.0.2.3", "dynamic": "true", "timeout": "1h"}, false)
+	if c := next(); c != nil || len(mt.dynlist) != 2 {
+		t.Errorf("tracked() = %v, %v for entries not ours", c, mt.dynlist)
+	}
+	// Additions by hand are tracked and propagated.
+	mt.tracked(map[string]string{".id": "*4", "list": "voip", "address": "192.0.2.4", "dynamic": "true", "timeout": "1h", "comment": "banned by admin"}, false)
+	if c := next(); c == nil || c.removed || c.ip.List != "voip" || c.ip.Net.String() != "192.0.2.4/32" || !strings.HasPrefix(c.comment, "fwban r=manual ") {
+		t.Errorf("tracked() = %v, expected a ban of 192.0.2.4/32 on voip", c)
+	}
+	if len(mt.dynlist) != 3 {
+		t.Errorf("dynlist = %v, expected the addition to be tracked", mt.dynlist)
+	}
+	// IDs are only unique within a family.
+	mt.tracked(map[string]string{".id": "*9", ".dead": "true"}, true)
+	if c := next(); c != nil || len(mt.dynlist) != 3 {
+		t.Errorf("tracked() = %v, %v for the removal of an IPv6 entry", c, mt.dynlist)
+	}
+	// Removals by hand are propagated, expiries are not.
+	mt.tracked(map[string]string{".id": "*a", ".dead": "true"}, false)
+	if c := next(); c != nil || len(mt.dynlist) != 2 {
+		t.Errorf("tracked() = %v, %v for an expired entry", c, mt.dynlist)
+	}
+	mt.tracked(map[string]string{".id": "*9", ".dead": "true"}, false)
+	if c := next(); c == nil || !c.removed || c.ip.Net.String() != "192.0.2.9/32" {
+		t.Errorf("tracked() = %v, expected an unban of 192.0.2.9/32", c)
+	}
+	if len(mt.dynlist) != 1 {
+		t.Errorf("dynlist = %v, expected the removal to be tracked", mt.dynlist)
+	}
+}
@@ -17,10 +17,12 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"strings"
@@ -28,20 +30,19 @@ import (
 
 	"github.com/google/gops/agent"
 	"github.com/howeyc/fsnotify"
-	"github.com/jeromer/syslogparser"
-	"github.com/jeromer/syslogparser/rfc3164"
-	"github.com/jeromer/syslogparser/rfc5424"
 )
 
 var (
 	filename      = flag.String("filename", "/etc/mikrotik-fwban.cfg", "Path of the configuration file to read.")
 	port          = flag.Uint("port", 0, "UDP port we listen on for syslog formatted messages.")
+	tcpport       = flag.Uint("tcpport", 0, "TCP port we listen on for syslog formatted messages.")
 	autodelete    = flag.Bool("autodelete", false, "Autodelete entries when they expire. Aka, don't trust Mikrotik to do it for us.")
 	blocktime     = flag.Duration("blocktime", 0, "Set the life time for dynamically managed entries.")
 	debug         = flag.Bool("debug", false, "Be absolutely staggering in our logging.")
 	verbose       = flag.Bool("verbose", false, "Be more verbose in our logging.")
 	configchanged = flag.Bool("configchange", false, "Exit process when config file changes.")
 	hasVersion    = flag.Bool("version", false, "output version information and exit")
+	replayfile    = flag.String("replay", "", "Run the lines of this file (- for stdin) through the regexps, report the would-be bans and exit.")
 
 	version = "dev"
 	cfg     Config
@@ -71,11 +72,38 @@ func main() {
 	}
 
 	var err error
-	cfg, err = newConfigFile(*filename, uint16(*port), Duration(*blocktime), *autodelete, *verbose)
+	cfg, err = newConfigFile(*filename, uint16(*port), uint16(*tcpport), Duration(*blocktime), *autodelete, *verbose)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if flag.Arg(0) == "test-regex" {
+		if err := testRegex(flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "bans" {
+		db, err := loadBanDB()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := db.dump(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.NArg() != 0 {
+		log.Fatalf("unknown command %q", flag.Arg(0))
+	}
+
+	if *replayfile != "" {
+		if err := replayFile(*replayfile); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Start the gops diagnostic agent.
 	if err := agent.Listen(agent.Options{}); err != nil {
 		log.Fatal(err)
@@ -101,11 +129,26 @@ func main() {
 		}
 	}
 
+	if cfg.Settings.Instance == "" {
+		log.Printf("Warning: instance not set, marking our entries as %q. Renaming the host disowns them, unless listed in adopt.", instanceName())
+	}
+	if bans, err = loadBanDB(); err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Settings.RecidiveFactor != 0 {
+		if recidive, err = loadHistory(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// Open connections to each mikrotik and build a list of the unique
 	// IPs they all have.
 	var mts []*Mikrotik
-	mergeIP := make(map[string]BlackIP)
 	ctx := context.Background()
+	go bans.run(ctx)
+	if recidive != nil {
+		go recidive.run(ctx)
+	}
 	for k, v := range cfg.Mikrotik {
 		if v.Disabled {
 			log.Printf("%s: definition disabled, skipping\n", k)
@@ -120,76 +163,75 @@ func main() {
 				log.Fatalf("Unable to close Mikrotik session: %v", err)
 			}
 		}()
-		for _, ip := range mt.GetIPs() {
-			if _, ok := mergeIP[ip.Net.String()]; !ok {
-				mergeIP[ip.Net.String()] = ip
-			}
-		}
 		mts = append(mts, mt)
 	}
 
-	// Distribute the missing dynamic IPs to all mikrotiks.
-	for _, mt := range mts {
-		ips := mt.GetIPs()
-		for k, ip := range mergeIP {
-			found := false
-			for _, ip2 := range ips {
-				if k == ip2.Net.String() {
-					found = true
-					break
-				}
-			}
-			if !found {
-				_ = mt.AddIP(ctx, ip.Net, Duration(time.Until(ip.Dead)), "")
-			}
-		}
+	// Distribute the missing dynamic IPs to all mikrotiks managing the
+	// same banlist.
+	syncDynlists(ctx, mts)
+	if cfg.Settings.Reconcile != 0 {
+		go runReconcile(ctx, mts, time.Duration(cfg.Settings.Reconcile))
 	}
+	go propagateChanges(ctx, mts)
 
 	DumpDynList(mts)
 
-	// Start listening to the socket for syslog messages.
-	listener, err := net.ListenPacket("udp", fmt.Sprintf(":%d", cfg.Settings.Port))
-	if err != nil {
-		log.Fatalln(err)
+	for _, j := range cfg.jails {
+		if j.hits != nil {
+			go j.hits.run(ctx)
+		}
+	}
+
+	// Start the matchers, decoupling the receivers from the Mikrotiks.
+	d := newDispatcher(ctx, mts)
+
+	// Publish the metrics, if so configured.
+	if cfg.Settings.MetricsAddr != "" {
+		go func() {
+			log.Fatalln(http.ListenAndServe(cfg.Settings.MetricsAddr, nil))
+		}()
 	}
-	pkt := make([]byte, 4096)
-	for {
-		n, _, err := listener.ReadFrom(pkt)
+
+	// Start listening on the TCP socket, if so configured.
+	if cfg.Settings.TCPPort != 0 {
+		tcplistener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.Settings.TCPPort))
 		if err != nil {
 			log.Fatalln(err)
 		}
+		go serveTCP(ctx, tcplistener, d)
+	}
 
-		var parser syslogparser.LogParser
-		parser = rfc3164.NewParser(pkt[:n])
-		msg := "content"
-		if err = parser.Parse(); err != nil {
-			parser = rfc5424.NewParser(pkt[:n])
-			if err = parser.Parse(); err != nil {
-				log.Println(err)
-				continue
-			}
-			msg = "message"
+	// Start listening on the TLS socket (RFC 5425), if so configured.
+	if cfg.Settings.TLSPort != 0 {
+		tc, err := newTLSConfig(cfg.Settings.TLSCert, cfg.Settings.TLSKey, cfg.Settings.TLSCA)
+		if err != nil {
+			log.Fatalln(err)
 		}
-		logparts := parser.Dump()
-		for _, re := range cfg.re {
-			text := strings.TrimSpace(logparts[msg].(string))
-			if res := re.RE.FindStringSubmatch(text); len(res) > 0 {
-				if *debug {
-					log.Printf("MATCH!!! %s\n", string(pkt[:n]))
-					log.Printf("%#v\n", res[1:])
-				}
-				if ip := parseCIDR(res[re.IPIndex], cfg.Settings.Verbose); ip != nil {
-					for _, mt := range mts {
-						if err = mt.AddIP(ctx, *ip, cfg.Settings.BlockTime, text); err != nil {
-							log.Fatalln(err)
-							continue
-						}
-					}
-				} else {
-					log.Printf("Unable to parse ip from %q (idx=%v)\n", res[re.IPIndex], re.IPIndex)
-				}
-				break
-			}
+		tlslistener, err := tls.Listen("tcp", fmt.Sprintf(":%d", cfg.Settings.TLSPort), tc)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go serveTCP(ctx, tlslistener, d)
+	}
+
+	// Create the local unix socket, if so configured.
+	if cfg.Settings.UnixSocket != "" {
+		if err := serveUnix(ctx, cfg.Settings.UnixSocket, cfg.Settings.UnixType, cfg.unixMode, d); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Start tailing the log files, if any are configured.
+	if len(cfg.File) != 0 {
+		if err := tailFiles(ctx, cfg.File, d); err != nil {
+			log.Fatalln(err)
 		}
 	}
+
+	// Start listening to the socket for syslog messages.
+	listener, err := net.ListenPacket("udp", fmt.Sprintf(":%d", cfg.Settings.Port))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Fatalln(servePacket(listener, listener.LocalAddr().String(), d))
 }
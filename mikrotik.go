@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
@@ -10,6 +11,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	ros "github.com/go-routeros/routeros/v3"
@@ -32,13 +34,21 @@ func (a ByAge) Less(i, j int) bool { return a[i].Dead.Before(a[j].Dead) }
 // a timeout value, where IsZero means it has no timeout, aka a permanent
 // entry. ID is used to store the row identifier Mikrotik gives us when
 // reading the IP. It will contain ".gcfg" for config based entries.
+// List is the address list the entry lives on, empty for the banlist of
+// the Mikrotik. Comment is the parsed comment of the entry, nil when it was
+// not created by fwban.
 type BlackIP struct {
-	Net  net.IPNet
-	Dead time.Time
-	ID   string
+	Net     net.IPNet
+	Dead    time.Time
+	ID      string
+	List    string
+	Comment *banComment
 }
 
 func (b BlackIP) String() string {
+	if b.List != "" {
+		return fmt.Sprintf("{%s, %q, %q, %q}", b.Net.String(), b.Dead.Format(time.RFC3339), b.ID, b.List)
+	}
 	return fmt.Sprintf("{%s, %q, %q}", b.Net.String(), b.Dead.Format(time.RFC3339), b.ID)
 }
 
@@ -46,22 +56,35 @@ func (b BlackIP) String() string {
 // details but also the API connection to the Mikrotik. It acts as a cache
 // between the rest of the program and the Mikrotik.
 type Mikrotik struct {
-	client *ros.Client
-	lock   sync.Mutex // protect AddIP/DelIP racing against AutoDelete.
+	client    atomic.Pointer[ros.Client] // nil while disconnected.
+	lock      sync.Mutex                 // protect AddIP/DelIP racing against AutoDelete.
+	degraded  atomic.Bool
+	reconnect chan struct{}
+	config    *ConfigMikrotik
+	queue     opQueue // Changes made while degraded.
+
+	bans        chan ban // Bans waiting for the ban worker.
+	bansSpilled expvar.Int
+	drift       expvar.Int // Entries found changed by reconcile.
 
 	Name string
 
 	Address string
 	User    string
 	Passwd  string
+	sources []net.IP // Addresses our syslog messages come from.
 
 	hasData chan struct{}
 	banlist string
+	lists   []string // Additional banlists, used by jails.
 
 	sync.RWMutex // Protect maps.
 	dynlist      []BlackIP
 	blacklist    []BlackIP
 	whitelist    []BlackIP
+	aggregates   map[string]*aggregate
+	adding       map[string]int // Additions in flight, see markOwn.
+	removing     map[string]int // Removals in flight, see markOwn.
 }
 
 // NewMikrotik returns an initialized Mikrotik object.
@@ -77,52 +100,101 @@ func NewMikrotik(ctx context.Context, name string, c *ConfigMikrotik) (*Mikrotik
 		User:    c.User,
 		Passwd:  c.Passwd,
 		banlist: c.BanList,
+		sources: resolveSources(name, c),
+		config:  c,
+
+		reconnect: make(chan struct{}, 1),
+		bans:      make(chan ban, banQueueSize),
+
+		aggregates: make(map[string]*aggregate),
 	}
-	var err error
-	dialctx, cancel := context.WithTimeout(ctx, time.Minute)
-	if c.UseTLS {
-		mt.client, err = ros.DialTLSContext(dialctx, mt.Address, mt.User, mt.Passwd, nil)
-	} else {
-		mt.client, err = ros.DialContext(dialctx, mt.Address, mt.User, mt.Passwd)
-	}
-	cancel()
-	if err != nil {
-		return nil, nil, err
+	for _, j := range cfg.jails {
+		if j.appliesTo(name) && j.banlist != "" && !mt.manages(j.banlist) {
+			mt.lists = append(mt.lists, j.banlist)
+		}
 	}
-	defer func() {
-		if err != nil {
-			cerr := mt.client.Close()
-			if cerr != nil {
-				err = fmt.Errorf("error closing object: %w, original error: %w", cerr, err)
-			}
+	// Catch typos in the config now, rather than while connecting.
+	for _, v := range append(append([]string(nil), c.Whitelist...), c.Blacklist...) {
+		if !strings.HasPrefix(v, "@") && parseCIDR(v, false) == nil {
+			return nil, nil, fmt.Errorf("%s: Unable to parse prefix/ip %s", mt.Name, v)
 		}
-	}()
+	}
 
-	if err := mt.populateBanlist(ctx, c.Whitelist, c.Blacklist); err != nil {
+	if err := mt.loadQueue(); err != nil {
 		return nil, nil, err
 	}
 
+	mt.degraded.Store(true)
+	if cfg.Settings.AutoDelete {
+		mt.hasData = make(chan struct{})
+	}
+	if err := mt.connect(ctx); err != nil {
+		// Keep trying in the background, the other Mikrotiks should not
+		// suffer from this one being down.
+		log.Printf("%s: unable to connect, degraded: %v", mt.Name, err)
+		select {
+		case mt.reconnect <- struct{}{}:
+		default:
+		}
+	}
+	go mt.maintain(ctx)
+	go mt.banWorker(ctx)
+	go mt.runQueue(ctx)
+	mikrotikMetrics.Set(name, expvar.Func(mt.metrics))
+
 	if cfg.Settings.AutoDelete {
 		// Start a go routine to monitor the dynlist for entries to delete.
 		// It effectively implements a priority queue on the Dead time.
 		// From now on we need locking if we mess with the dynlist.
-		mt.hasData = make(chan struct{})
 		go mt.autoDelete(ctx)
 	}
-	return mt, func(ctx context.Context) error { return mt.client.Close() }, nil
+	if cfg.Settings.AggregateCount != 0 {
+		go mt.runAggregates(ctx)
+	}
+	return mt, func(ctx context.Context) error {
+		mt.queue.flush()
+		return mt.Close()
+	}, nil
+}
+
+// manages reports whether the named address list is one of the banlists
+// managed by us.
+func (mt *Mikrotik) manages(list string) bool {
+	if list == mt.banlist {
+		return true
+	}
+	for _, l := range mt.lists {
+		if l == list {
+			return true
+		}
+	}
+	return false
+}
+
+// listName returns the name of the address list on the Mikrotik, with the
+// empty name being the banlist of the Mikrotik.
+func (mt *Mikrotik) listName(list string) string {
+	if list == "" {
+		return mt.banlist
+	}
+	return list
 }
 
 func (mt *Mikrotik) populateBanlist(ctx context.Context, whitelist, blacklist []string) error {
 	// Setup the whitelist.
 	for _, v := range whitelist {
 		if strings.HasPrefix(v, "@") {
-			if v[1:] == mt.banlist {
+			if mt.manages(v[1:]) {
 				log.Printf("%s: Skipping the managed banlist %s", mt.Name, v)
 			} else {
-				mt.whitelist = append(mt.whitelist, mt.getAddresslist(ctx, v[1:])...)
+				ips, err := mt.getAddresslist(ctx, v[1:])
+				if err != nil {
+					return err
+				}
+				mt.whitelist = append(mt.whitelist, ips...)
 			}
 		} else if ip := parseCIDR(v, cfg.Settings.Verbose); ip != nil {
-			mt.whitelist = append(mt.whitelist, BlackIP{*ip, time.Time{}, ".gcfg"})
+			mt.whitelist = append(mt.whitelist, BlackIP{*ip, time.Time{}, ".gcfg", "", nil})
 		} else {
 			return fmt.Errorf("%s: Unable to parse whitelist prefix/ip %s", mt.Name, v)
 		}
@@ -130,13 +202,17 @@ func (mt *Mikrotik) populateBanlist(ctx context.Context, whitelist, blacklist []
 	// Fill the blacklist, aka permanent blacklist members.
 	for _, v := range blacklist {
 		if strings.HasPrefix(v, "@") {
-			if v[1:] == mt.banlist {
+			if mt.manages(v[1:]) {
 				log.Printf("%s: Skipping the managed banlist %s", mt.Name, v)
 			} else {
-				mt.blacklist = append(mt.blacklist, mt.getAddresslist(ctx, v[1:])...)
+				ips, err := mt.getAddresslist(ctx, v[1:])
+				if err != nil {
+					return err
+				}
+				mt.blacklist = append(mt.blacklist, ips...)
 			}
 		} else if ip := parseCIDR(v, cfg.Settings.Verbose); ip != nil {
-			mt.blacklist = append(mt.blacklist, BlackIP{*ip, time.Time{}, ".gcfg"})
+			mt.blacklist = append(mt.blacklist, BlackIP{*ip, time.Time{}, ".gcfg", "", nil})
 		} else {
 			return fmt.Errorf("%s: Unable to parse blacklist prefix/ip %s", mt.Name, v)
 		}
@@ -155,14 +231,38 @@ func (mt *Mikrotik) populateBanlist(ctx context.Context, whitelist, blacklist []
 		}
 	}
 
+	// Entries written by older versions are adopted on the first run.
+	migrated, err := adoptedBefore(mt.Name)
+	if err != nil {
+		return err
+	}
+
 	// Now check every entry from the managed dynlist.
+	banlist, err := mt.getAddresslist(ctx, mt.banlist)
+	if err != nil {
+		return err
+	}
 addresslist:
-	for _, v := range mt.getAddresslist(ctx, mt.banlist) {
+	for _, v := range banlist {
+		// Entries created by others are left alone, see parseComment.
+		ours, err := mt.adopt(ctx, &v, !migrated)
+		if err != nil {
+			return err
+		}
+		if !ours {
+			if v.Dead.IsZero() {
+				delete(blackmap, v.Net.String())
+			}
+			if *debug {
+				log.Printf("%s: Leaving alone entry %s, not created by us", mt.Name, v.Net.String())
+			}
+			continue
+		}
 		// Whitelisted entries should never be on the banlist.
 		for _, w := range mt.whitelist {
-			if w.Net.Contains(v.Net.IP) {
+			if overlaps(w.Net, v.Net) {
 				log.Printf("%s(%s): Deleting whitelisted entry %s", mt.Name, mt.banlist, v.Net.String())
-				if err := mt.DelIP(ctx, v); err != nil {
+				if err := mt.delIP(ctx, v); err != nil {
 					return err
 				}
 				// No use checking the rest, it's dead Jim.
@@ -177,7 +277,7 @@ addresslist:
 			} else {
 				// Remove this permanent entry as it is not on permanent blacklist.
 				log.Printf("%s: Deleting unwanted permanent blacklist entry %s", mt.Name, v.Net.String())
-				if err := mt.DelIP(ctx, v); err != nil {
+				if err := mt.delIP(ctx, v); err != nil {
 					return err
 				}
 			}
@@ -187,33 +287,95 @@ addresslist:
 				// Remove this dynamic entry as it is on the permanent blacklist.
 				// It will be added back later as a permanent entry.
 				log.Printf("%s: Deleting unwanted dynamic blacklist entry %s", mt.Name, v.Net.String())
-				if err := mt.DelIP(ctx, v); err != nil {
+				if err := mt.delIP(ctx, v); err != nil {
 					return err
 				}
 			} else {
 				// Dynamic entry. All good.
 				mt.dynlist = append(mt.dynlist, v)
+				bans.recover(mt.Name, v)
 			}
 		}
 	}
 	// Add the remaining (missing) permanent blacklist entries.
+	var missing []ban
 	for _, v := range blackmap {
-		if err := mt.AddIP(ctx, v.Net, 0, ""); err != nil {
+		missing = append(missing, ban{ip: v.Net, comment: newComment("blacklist", time.Now(), 1).String()})
+	}
+	for _, err := range mt.addIPs(ctx, missing) {
+		if err != nil {
+			return err
+		}
+	}
+
+	// The banlists of the jails only hold dynamic entries, permanent
+	// entries on them, like all entries created by others, are left alone.
+	extra, err := mt.getExtraAddresslists(ctx)
+	if err != nil {
+		return err
+	}
+extralist:
+	for _, v := range extra {
+		ours, err := mt.adopt(ctx, &v, !migrated)
+		if err != nil {
 			return err
 		}
+		if !ours {
+			continue
+		}
+		for _, w := range mt.whitelist {
+			if overlaps(w.Net, v.Net) {
+				log.Printf("%s(%s): Deleting whitelisted entry %s", mt.Name, v.List, v.Net.String())
+				if err := mt.delIP(ctx, v); err != nil {
+					return err
+				}
+				continue extralist
+			}
+		}
+		if !v.Dead.IsZero() {
+			mt.dynlist = append(mt.dynlist, v)
+			bans.recover(mt.Name, v)
+		}
 	}
+	sort.Sort(ByAge(mt.dynlist))
+	mt.recoverAggregates()
+	markAdopted(mt.Name)
 
 	return nil
 }
 
+// getExtraAddresslists returns the entries of all the banlists used by
+// jails, next to the banlist of the Mikrotik.
+func (mt *Mikrotik) getExtraAddresslists(ctx context.Context) ([]BlackIP, error) {
+	var ips []BlackIP
+	for _, l := range mt.lists {
+		list, err := mt.getAddresslist(ctx, l)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, list...)
+	}
+	return ips, nil
+}
+
 func (mt *Mikrotik) autoDelete(ctx context.Context) {
 	var oldest time.Time
 	var oldestEntry *BlackIP
 	for {
 		mt.RLock()
-		if len(mt.dynlist) != 0 {
+		if mt.Degraded() {
+			// Removals would fail right away, wait for connect to
+			// signal it is back. Poll as well, the signal is dropped
+			// when we are not waiting for it.
+			if *debug {
+				log.Printf("%s: Degraded, waiting for reconnect", mt.Name)
+			}
+			oldest = time.Now().Add(time.Minute)
+			oldestEntry = nil
+		} else if len(mt.dynlist) != 0 {
 			oldest = mt.dynlist[0].Dead
-			oldestEntry = &mt.dynlist[0]
+			entry := mt.dynlist[0]
+			oldestEntry = &entry
 		} else {
 			if *debug {
 				log.Printf("%s: No dynlist entries found to expire, retry in an hour", mt.Name)
@@ -242,7 +404,7 @@ func (mt *Mikrotik) autoDelete(ctx context.Context) {
 					log.Printf("%s: Deleting oldest dynlist entry", mt.Name)
 				}
 				if err := mt.DelIP(ctx, *oldestEntry); err != nil {
-					log.Fatalln(mt.Name, err)
+					log.Printf("%s: %v", mt.Name, err)
 				}
 			}
 		}
@@ -287,34 +449,26 @@ func (mt *Mikrotik) toDuration(mapname string, dict map[string]string) time.Time
 	return time.Time{} // permanent entry.
 }
 
-func (mt *Mikrotik) getAddresslist(ctx context.Context, mapname string) []BlackIP {
+func (mt *Mikrotik) getAddresslist(ctx context.Context, mapname string) ([]BlackIP, error) {
 	var ips []BlackIP
 
 	list := fmt.Sprintf("?list=%s", mapname)
-	rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	reply, err := mt.client.RunContext(rctx, "/ip/firewall/address-list/getall", list)
-	cancel()
-	if err != nil {
-		log.Fatalln(err)
+	// Entries on the banlist are stored without list name.
+	name := mapname
+	if mapname == mt.banlist {
+		name = ""
 	}
-	for _, re := range reply.Re {
-		ip := parseCIDR(re.Map["address"], cfg.Settings.Verbose)
-		if ip != nil {
-			duration := mt.toDuration(mapname, re.Map)
-			ips = append(ips, BlackIP{*ip, duration, re.Map[".id"]})
+	for _, cmd := range []string{"/ip/firewall/address-list/getall", "/ipv6/firewall/address-list/getall"} {
+		reply, err := mt.run(ctx, cmd, list)
+		if err != nil {
+			return nil, fmt.Errorf("%s(%s): %w", mt.Name, mapname, err)
 		}
-	}
-	rctx, cancel = context.WithTimeout(ctx, 5*time.Second)
-	reply, err = mt.client.RunContext(rctx, "/ipv6/firewall/address-list/getall", list)
-	cancel()
-	if err != nil {
-		log.Fatalln(err)
-	}
-	for _, re := range reply.Re {
-		ip := parseCIDR(re.Map["address"], cfg.Settings.Verbose)
-		if ip != nil {
-			duration := mt.toDuration(mapname, re.Map)
-			ips = append(ips, BlackIP{*ip, duration, re.Map[".id"]})
+		for _, re := range reply.Re {
+			ip := parseCIDR(re.Map["address"], cfg.Settings.Verbose)
+			if ip != nil {
+				duration := mt.toDuration(mapname, re.Map)
+				ips = append(ips, BlackIP{*ip, duration, re.Map[".id"], name, parseComment(re.Map["comment"])})
+			}
 		}
 	}
 	sort.Sort(ByAge(ips))
@@ -323,11 +477,34 @@ func (mt *Mikrotik) getAddresslist(ctx context.Context, mapname string) []BlackI
 	} else if cfg.Settings.Verbose {
 		log.Printf("%s: getAddresslist(%s)", mt.Name, mapname)
 	}
-	return ips
+	return ips, nil
 }
 
-// DelIP removed an ip address from the Mikrotik.
+// DelIP removed an ip address from the Mikrotik. While the Mikrotik is
+// degraded, the removal is queued instead. Either way the entry is gone
+// from the dynlist, so it is not removed again.
 func (mt *Mikrotik) DelIP(ctx context.Context, ip BlackIP) error {
+	if mt.queueDel(ip) {
+		mt.forget(ip)
+		return nil
+	}
+	return mt.delIP(ctx, ip)
+}
+
+// forget removes the entry from the dynlist.
+func (mt *Mikrotik) forget(ip BlackIP) {
+	mt.Lock()
+	defer mt.Unlock()
+	for i, v := range mt.dynlist {
+		if v.ID == ip.ID {
+			mt.dynlist = append(mt.dynlist[:i:i], mt.dynlist[i+1:]...)
+			break
+		}
+	}
+}
+
+// delIP implements DelIP, also while resynchronizing.
+func (mt *Mikrotik) delIP(ctx context.Context, ip BlackIP) error {
 	if *debug || cfg.Settings.Verbose {
 		defer log.Printf("%s: DelIP(%s) finished", mt.Name, ip.String())
 	}
@@ -339,116 +516,190 @@ func (mt *Mikrotik) DelIP(ctx context.Context, ip BlackIP) error {
 		log.Printf("%s: DelIP(%s) started", mt.Name, ip.String())
 	}
 	selector := fmt.Sprintf("=.id=%s", ip.ID)
-	var err error
-	rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	if ip.Net.IP.To4() != nil {
-		_, err = mt.client.RunContext(rctx, "/ip/firewall/address-list/remove", selector)
-	} else {
-		_, err = mt.client.RunContext(rctx, "/ipv6/firewall/address-list/remove", selector)
-	}
-	cancel()
-	if err == nil && cfg.Settings.AutoDelete {
-		mt.Lock()
-		// We expect to be called with the oldest entry. Delete that.
-		if mt.dynlist[0].ID == ip.ID {
-			mt.dynlist = mt.dynlist[1:]
-		}
-		mt.Unlock()
+	cmd := "/ip/firewall/address-list/remove"
+	if ip.Net.IP.To4() == nil {
+		cmd = "/ipv6/firewall/address-list/remove"
+	}
+	own := []string{familyID(ip.Net.IP.To4() == nil, ip.ID)}
+	mt.markOwn(own, true)
+	defer mt.unmarkOwn(own, true)
+	_, err := mt.run(ctx, cmd, selector)
+	if err == nil {
+		mt.forget(ip)
 	}
 	return err
 }
 
-// AddIP will add the given ip address to the Mikrotik, when duration is 0,
+// AddIP will add the given ip address to the named address list on the
+// Mikrotik, an empty list being its banlist. When duration is 0,
 // the entry is seen as permanent and the white and blacklist are not checked
 // for duplicates. Conflicts on those lists are checked when the configuration
 // is read. It protects against double adding, as that will make the Mikrotik
 // spit out an error which in the current implementation leads to a program
 // restart. For all timeouts != 0, the index returned over the Mikrotik
 // connection is stored, together with the IP itself, in the dynlist entry.
-func (mt *Mikrotik) AddIP(ctx context.Context, ip net.IPNet, duration Duration, comment string) error {
+// While the Mikrotik is degraded, the addition is queued instead.
+func (mt *Mikrotik) AddIP(ctx context.Context, list string, ip net.IPNet, duration Duration, comment string) error {
+	if mt.queueAdd(list, ip, duration, comment) {
+		return nil
+	}
+	return mt.addIP(ctx, list, ip, duration, comment)
+}
+
+// addIP implements AddIP, also while resynchronizing.
+func (mt *Mikrotik) addIP(ctx context.Context, list string, ip net.IPNet, duration Duration, comment string) error {
+	return mt.addIPs(ctx, []ban{{list, ip, duration, comment}})[0]
+}
+
+// addIPs adds a batch of entries, see AddIP. The additions are pipelined
+// over the connection instead of waiting for each reply in turn. It returns
+// the error of every entry, so one failing entry does not fail the others.
+func (mt *Mikrotik) addIPs(ctx context.Context, bans []ban) []error {
 	if *debug || cfg.Settings.Verbose {
-		defer log.Printf("%s: AddIP(%s/%v) finished", mt.Name, ip.String(), duration)
+		defer log.Printf("%s: AddIP(%d entries) finished", mt.Name, len(bans))
 	}
 	// Protect against racing DelIP/AddIPs.
 	mt.lock.Lock()
 	defer mt.lock.Unlock()
 
 	if *debug || cfg.Settings.Verbose {
-		log.Printf("%s: AddIP(%s/%v) started", mt.Name, ip.String(), duration)
+		log.Printf("%s: AddIP(%d entries) started", mt.Name, len(bans))
 	}
-	// For permanent members skip the built-in white/blacklist checking.
-	if duration != 0 {
-		// Check if it is on the whitelist
-		for _, v := range mt.whitelist {
-			if v.Net.Contains(ip.IP) {
-				log.Printf("%s: AddIP(%v) is on the admin whitelist, skipped", mt.Name, ip.IP)
-				return nil
-			}
+	var (
+		errs    = make([]error, len(bans))
+		replies = make([]*ros.Reply, len(bans))
+		skip    = make([]bool, len(bans))
+		wg      sync.WaitGroup
+	)
+	var own []string
+	defer func() { mt.unmarkOwn(own, false) }()
+	for i := range bans {
+		b := &bans[i]
+		if b.list == mt.banlist {
+			b.list = ""
+		}
+		if skip[i] = mt.skipAdd(bans[:i], *b); skip[i] {
+			continue
+		}
+		own = append(own, b.list+" "+b.ip.String())
+		mt.markOwn(own[len(own)-1:], false)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replies[i], errs[i] = mt.run(ctx, mt.addArgs(*b)...)
+		}()
+	}
+	wg.Wait()
+
+	added := false
+	for i, b := range bans {
+		if skip[i] {
+			continue
 		}
-		// Check if it is on the permanent blacklist.
-		for _, v := range mt.blacklist {
-			if v.Net.Contains(ip.IP) {
-				log.Printf("%s: AddIP(%v) is on the admin blacklist, skipped", mt.Name, ip.IP)
-				return nil
+		if errs[i] != nil {
+			if strings.Contains(errs[i].Error(), "already have") {
+				errs[i] = nil
+			} else {
+				errs[i] = fmt.Errorf("addip=%w", errs[i])
 			}
+			continue
 		}
-		mt.RLock()
-		for _, v := range mt.dynlist {
-			if v.Net.Contains(ip.IP) {
-				mt.RUnlock()
-				log.Printf("%s: AddIP(%v) is already on the dynamic blacklist, skipped", mt.Name, ip.IP)
-				return nil
+		id, ok := replies[i].Done.Map["ret"]
+		if !ok {
+			errs[i] = fmt.Errorf("missing `ret`")
+			continue
+		}
+		// Add the entry to the dynlist if it has a timeout.
+		if b.duration != 0 {
+			mt.Lock()
+			mt.dynlist = append(mt.dynlist, BlackIP{b.ip, time.Now().Add(time.Duration(b.duration)), id, b.list, parseComment(b.comment)})
+			mt.Unlock()
+			added = true
+		}
+	}
+	if added {
+		mt.Lock()
+		sort.Sort(ByAge(mt.dynlist))
+		mt.Unlock()
+		if cfg.Settings.AutoDelete {
+			// Tell auto deleter new data has arrived.
+			select {
+			case mt.hasData <- struct{}{}:
+			default:
+				log.Printf("hasData full, deadlock?")
 			}
 		}
-		mt.RUnlock()
 	}
+	return errs
+}
 
-	// Do the physical interaction with the MT.
-	args := []string{
-		"/ip/firewall/address-list/add",
-		fmt.Sprintf("=address=%s", ip.String()),
-		fmt.Sprintf("=list=%s", mt.banlist),
+// skipAdd reports whether adding b is not needed, because it is on the
+// admin whitelist or blacklist, or already on the dynamic list, or added
+// by one of the earlier entries of the batch. For permanent entries the
+// white and blacklist are not checked. The caller holds mt.lock.
+func (mt *Mikrotik) skipAdd(earlier []ban, b ban) bool {
+	// For permanent members skip the built-in white/blacklist checking.
+	if b.duration == 0 {
+		return false
 	}
-	if ip.IP.To4() == nil {
-		args[0] = "/ipv6/firewall/address-list/add"
+	// Check if it is on the whitelist, any overlap will do.
+	for _, v := range mt.whitelist {
+		if overlaps(v.Net, b.ip) {
+			log.Printf("%s: AddIP(%v) is on the admin whitelist, skipped", mt.Name, b.ip.String())
+			return true
+		}
 	}
-	if duration != 0 {
-		args = append(args, fmt.Sprintf("=timeout=%s", duration))
+	// Check if it is on the permanent blacklist.
+	for _, v := range mt.blacklist {
+		if covers(v.Net, b.ip) {
+			log.Printf("%s: AddIP(%v) is on the admin blacklist, skipped", mt.Name, b.ip.String())
+			return true
+		}
 	}
-	if comment != "" {
-		args = append(args, fmt.Sprintf("=comment=%s", comment))
+	for _, v := range earlier {
+		if v.list == b.list && v.duration != 0 && covers(v.ip, b.ip) {
+			return true
+		}
 	}
-	rctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-	reply, err := mt.client.RunArgsContext(rctx, args)
-	cancel()
-	if err != nil {
-		if strings.Contains(err.Error(), "already have") {
-			return nil
+	now := time.Now()
+	mt.Lock()
+	defer mt.Unlock()
+	if !cfg.Settings.AutoDelete {
+		// Nobody removes the expired entries for us.
+		for len(mt.dynlist) != 0 && !mt.dynlist[0].Dead.IsZero() && mt.dynlist[0].Dead.Before(now) {
+			mt.dynlist = mt.dynlist[1:]
 		}
-		return fmt.Errorf("addip=%v", err)
 	}
-	var (
-		id string
-		ok bool
-	)
-	if id, ok = reply.Done.Map["ret"]; !ok {
-		return fmt.Errorf("missing `ret`")
+	for _, v := range mt.dynlist {
+		if v.List == b.list && v.Dead.After(now) && covers(v.Net, b.ip) {
+			if a, ok := mt.aggregates[v.List+" "+v.Net.String()]; ok {
+				// Keep track of new members, for when we split.
+				a.members = append(a.members, BlackIP{b.ip, now.Add(time.Duration(b.duration)), "", b.list, parseComment(b.comment)})
+			}
+			log.Printf("%s: AddIP(%v) is already on the dynamic blacklist, skipped", mt.Name, b.ip.String())
+			return true
+		}
 	}
+	return false
+}
 
-	// Add the entry to the dynlist if it has a timeout.
-	if duration != 0 && cfg.Settings.AutoDelete {
-		mt.Lock()
-		mt.dynlist = append(mt.dynlist, BlackIP{ip, time.Now().Add(time.Duration(duration)), id})
-		sort.Sort(ByAge(mt.dynlist))
-		mt.Unlock()
-		// Tell auto deleter new data has arrived.
-		select {
-		case mt.hasData <- struct{}{}:
-		default:
-			log.Printf("hasData full, deadlock?")
-		}
+// addArgs returns the API command adding b.
+func (mt *Mikrotik) addArgs(b ban) []string {
+	args := []string{
+		"/ip/firewall/address-list/add",
+		fmt.Sprintf("=address=%s", b.ip.String()),
+		fmt.Sprintf("=list=%s", mt.listName(b.list)),
 	}
-	return nil
+	if b.ip.IP.To4() == nil {
+		args[0] = "/ipv6/firewall/address-list/add"
+	}
+	if b.duration != 0 {
+		args = append(args, fmt.Sprintf("=timeout=%s", b.duration))
+	}
+	if b.comment != "" {
+		args = append(args, fmt.Sprintf("=comment=%s", b.comment))
+	}
+	return args
 }
 
 // GetIPs returns the current list of blacklisted IPs.
@@ -45,3 +45,30 @@ func parseCIDR(s string, verbose bool) *net.IPNet {
 	}
 	return &net.IPNet{IP: ip.Mask(m), Mask: m}
 }
+
+// covers reports whether prefix a contains all of prefix b.
+func covers(a, b net.IPNet) bool {
+	aones, abits := a.Mask.Size()
+	bones, bbits := b.Mask.Size()
+	return abits == bbits && aones <= bones && a.Contains(b.IP)
+}
+
+// overlaps reports whether the prefixes a and b have any address in
+// common, which for prefixes means one of them contains the other.
+func overlaps(a, b net.IPNet) bool {
+	return covers(a, b) || covers(b, a)
+}
+
+// banPrefix widens ip to the configured ban prefix length of its address
+// family. Prefixes which are already wider are returned as is.
+func banPrefix(ip *net.IPNet) *net.IPNet {
+	bits, total := cfg.Settings.BanPrefixIPv4, 8*net.IPv4len
+	if ip.IP.To4() == nil {
+		bits, total = cfg.Settings.BanPrefixIPv6, 8*net.IPv6len
+	}
+	if ones, _ := ip.Mask.Size(); bits == 0 || ones <= bits {
+		return ip
+	}
+	m := net.CIDRMask(bits, total)
+	return &net.IPNet{IP: ip.IP.Mask(m), Mask: m}
+}
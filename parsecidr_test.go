@@ -47,3 +47,52 @@ func TestParseCIDR(t *testing.T) {
 		})
 	}
 }
+
+func TestCoversOverlaps(t *testing.T) {
+	testdata := []struct {
+		a, b     string
+		covers   bool
+		overlaps bool
+	}{
+		{"192.168.10.0/24", "192.168.10.5/32", true, true},
+		{"192.168.10.5/32", "192.168.10.0/24", false, true},
+		{"192.168.10.0/24", "192.168.10.0/24", true, true},
+		{"192.168.10.0/24", "192.168.11.0/24", false, false},
+		{"192.168.10.0/24", "192.168.0.0/16", false, true},
+		{"2001:db8::/32", "2001:db8:1::/48", true, true},
+		{"2001:db8::/32", "2001:db9::/48", false, false},
+		{"0.0.0.0/0", "::/0", false, false},
+	}
+	for _, d := range testdata {
+		t.Run(d.a+"_"+d.b, func(t *testing.T) {
+			a, b := parseCIDR(d.a, false), parseCIDR(d.b, false)
+			if got := covers(*a, *b); got != d.covers {
+				t.Errorf("covers(%s, %s) = %v, expected %v", d.a, d.b, got, d.covers)
+			}
+			if got := overlaps(*a, *b); got != d.overlaps {
+				t.Errorf("overlaps(%s, %s) = %v, expected %v", d.a, d.b, got, d.overlaps)
+			}
+		})
+	}
+}
+
+func TestBanPrefix(t *testing.T) {
+	cfg.Settings.BanPrefixIPv4 = 32
+	cfg.Settings.BanPrefixIPv6 = 64
+	defer func() { cfg = Config{} }()
+
+	testdata := []struct {
+		str    string
+		expect string
+	}{
+		{"1.2.3.4", "1.2.3.4/32"},
+		{"1.2.3.0/24", "1.2.3.0/24"},
+		{"2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{"2001:db8:1::/48", "2001:db8:1::/48"},
+	}
+	for _, d := range testdata {
+		if got := banPrefix(parseCIDR(d.str, false)); got.String() != d.expect {
+			t.Errorf("banPrefix(%s) = %s, expected %s", d.str, got.String(), d.expect)
+		}
+	}
+}
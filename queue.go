@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// queuedOp is an address list change for a degraded Mikrotik, to be
+// applied when it is back. Op is either "add" or "del", List the address
+// list with the empty name being the banlist of the Mikrotik. Dead is the
+// end of an added entry, zero for permanent ones.
+type queuedOp struct {
+	Op      string
+	List    string
+	Net     string
+	Dead    time.Time `json:",omitempty"`
+	Comment string    `json:",omitempty"`
+}
+
+// key identifies the entry the operation is about.
+func (op queuedOp) key() string {
+	return op.List + " " + op.Net
+}
+
+// expired reports whether op adds an entry which is no longer needed.
+func (op queuedOp) expired(now time.Time) bool {
+	return op.Op == "add" && !op.Dead.IsZero() && !op.Dead.After(now)
+}
+
+// opQueue holds the pending changes of a Mikrotik in order, at most one
+// per entry. It is saved in the state directory at most once a second when
+// it changed, see runQueue, so it survives restarts.
+type opQueue struct {
+	sync.Mutex
+	file   string
+	ops    []queuedOp
+	dirty  bool
+	saving sync.Mutex // Keeps the writes of flush in order.
+}
+
+// queueFile returns the name of the file in the state directory holding
+// the queue of the named Mikrotik.
+func queueFile(name string) string {
+	return "queue-" + url.PathEscape(name) + ".json"
+}
+
+// loadQueue reads the pending changes of the Mikrotik from the state
+// directory.
+func (mt *Mikrotik) loadQueue() error {
+	mt.queue.file = queueFile(mt.Name)
+	if err := loadState(mt.queue.file, &mt.queue.ops); err != nil {
+		return err
+	}
+	if len(mt.queue.ops) != 0 {
+		log.Printf("%s: %d queued changes pending", mt.Name, len(mt.queue.ops))
+	}
+	return nil
+}
+
+// flush writes the queue to the state directory when it changed. It
+// writes a copy without holding the lock, so queueing a change, like Ban
+// spilling one, never waits for the disk.
+func (q *opQueue) flush() {
+	q.saving.Lock()
+	defer q.saving.Unlock()
+	q.Lock()
+	if !q.dirty {
+		q.Unlock()
+		return
+	}
+	ops := append([]queuedOp(nil), q.ops...)
+	q.dirty = false
+	q.Unlock()
+	if err := saveState(q.file, ops); err != nil {
+		log.Printf("Unable to save queue %s: %v", q.file, err)
+		q.Lock()
+		q.dirty = true
+		q.Unlock()
+	}
+}
+
+// runQueue saves the queue every second when it changed, until ctx is
+// done.
+func (mt *Mikrotik) runQueue(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			mt.queue.flush()
+			return
+		case <-ticker.C:
+			mt.queue.flush()
+		}
+	}
+}
+
+// queued appends op to the queue when the Mikrotik is degraded, reporting
+// whether it did, see push.
+func (mt *Mikrotik) queued(op queuedOp) bool {
+	q := &mt.queue
+	q.Lock()
+	defer q.Unlock()
+	if !mt.Degraded() {
+		return false
+	}
+	mt.push(op)
+	return true
+}
+
+// push appends op to the queue. An operation replaces any earlier one on
+// the same entry, only the last one matters. Of two adds, the longest
+// lasting is kept. The caller holds the queue lock.
+func (mt *Mikrotik) push(op queuedOp) {
+	q := &mt.queue
+	now := time.Now()
+	ops := q.ops[:0]
+	for _, v := range q.ops {
+		if v.key() == op.key() {
+			if v.Op == "add" && op.Op == "add" && (v.Dead.IsZero() || v.Dead.After(op.Dead)) {
+				op.Dead = v.Dead
+			}
+			continue
+		}
+		if !v.expired(now) {
+			ops = append(ops, v)
+		}
+	}
+	q.ops = append(ops, op)
+	q.dirty = true
+	if *debug || cfg.Settings.Verbose {
+		log.Printf("%s: queued %s %s (%d pending)", mt.Name, op.Op, op.Net, len(q.ops))
+	}
+}
+
+// flushQueue applies the queued changes in order, skipping adds which
+// expired meanwhile, and marks the Mikrotik no longer degraded once the
+// queue is empty, saving the now empty queue right away. Changes the Mikrotik rejects are dropped, when the
+// connection fails the remaining ones are kept for the next attempt.
+func (mt *Mikrotik) flushQueue(ctx context.Context) error {
+	q := &mt.queue
+	for {
+		q.Lock()
+		if len(q.ops) == 0 {
+			mt.degraded.Store(false)
+			q.Unlock()
+			q.flush()
+			return nil
+		}
+		op := q.ops[0]
+		q.ops = q.ops[1:]
+		q.dirty = true
+		q.Unlock()
+
+		err := mt.apply(ctx, op)
+		if err == nil {
+			continue
+		}
+		if isConnError(err) || errors.Is(err, errDegraded) {
+			q.Lock()
+			// Put it back, unless it got superseded meanwhile.
+			superseded := false
+			for _, v := range q.ops {
+				superseded = superseded || v.key() == op.key()
+			}
+			if !superseded {
+				q.ops = append([]queuedOp{op}, q.ops...)
+				q.dirty = true
+			}
+			q.Unlock()
+			return err
+		}
+		log.Printf("%s: dropping queued %s %s: %v", mt.Name, op.Op, op.Net, err)
+	}
+}
+
+// apply performs a single queued change.
+func (mt *Mikrotik) apply(ctx context.Context, op queuedOp) error {
+	ip := parseCIDR(op.Net, false)
+	if ip == nil {
+		return errors.New("unparsable prefix")
+	}
+	if op.Op == "add" {
+		if op.expired(time.Now()) {
+			return nil
+		}
+		var d Duration
+		if !op.Dead.IsZero() {
+			d = Duration(time.Until(op.Dead))
+		}
+		return mt.addIP(ctx, op.List, *ip, d, op.Comment)
+	}
+	mt.RLock()
+	var entry *BlackIP
+	for _, v := range mt.dynlist {
+		if v.List == op.List && v.Net.String() == ip.String() {
+			entry = &v
+			break
+		}
+	}
+	mt.RUnlock()
+	if entry == nil {
+		// Gone already, like when it expired.
+		return nil
+	}
+	return mt.delIP(ctx, *entry)
+}
+
+// addOp returns the operation adding ip to list.
+func (mt *Mikrotik) addOp(list string, ip net.IPNet, duration Duration, comment string) queuedOp {
+	if list == mt.banlist {
+		list = ""
+	}
+	op := queuedOp{Op: "add", List: list, Net: ip.String(), Comment: comment}
+	if duration != 0 {
+		op.Dead = time.Now().Add(time.Duration(duration))
+	}
+	return op
+}
+
+// queueAdd queues the addition of ip to list, see queued.
+func (mt *Mikrotik) queueAdd(list string, ip net.IPNet, duration Duration, comment string) bool {
+	return mt.queued(mt.addOp(list, ip, duration, comment))
+}
+
+// spill queues the addition of ip to list, even when the Mikrotik is not
+// degraded. It is used when its ban queue is full, see unspill.
+func (mt *Mikrotik) spill(list string, ip net.IPNet, duration Duration, comment string) {
+	q := &mt.queue
+	q.Lock()
+	defer q.Unlock()
+	mt.push(mt.addOp(list, ip, duration, comment))
+}
+
+// unspill applies the queued changes while the Mikrotik is not degraded,
+// like the bans spilled while the ban queue was full, in batches. While
+// degraded they are left to flushQueue.
+func (mt *Mikrotik) unspill(ctx context.Context) {
+	q := &mt.queue
+	for {
+		q.Lock()
+		if mt.Degraded() || len(q.ops) == 0 {
+			q.Unlock()
+			return
+		}
+		n := min(len(q.ops), maxBatch)
+		ops := append([]queuedOp(nil), q.ops[:n]...)
+		q.ops = q.ops[n:]
+		q.dirty = true
+		q.Unlock()
+
+		now := time.Now()
+		var batch []ban
+		for _, op := range ops {
+			ip := parseCIDR(op.Net, false)
+			switch {
+			case ip == nil || op.expired(now):
+			case op.Op == "add":
+				var d Duration
+				if !op.Dead.IsZero() {
+					d = Duration(op.Dead.Sub(now))
+				}
+				batch = append(batch, ban{op.List, *ip, d, op.Comment})
+			default:
+				if err := mt.apply(ctx, op); err != nil {
+					log.Printf("%s: %v", mt.Name, err)
+				}
+			}
+		}
+		mt.applyBans(ctx, batch)
+	}
+}
+
+// queueDel queues the removal of ip, see queued.
+func (mt *Mikrotik) queueDel(ip BlackIP) bool {
+	return mt.queued(queuedOp{Op: "del", List: ip.List, Net: ip.Net.String()})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	ros "github.com/go-routeros/routeros/v3"
+)
+
+func TestQueue(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	mt := &Mikrotik{Name: "MT/1", banlist: "blacklist"}
+	if err := mt.loadQueue(); err != nil {
+		t.Fatal(err)
+	}
+	ip := func(s string) BlackIP { return BlackIP{Net: *parseCIDR(s, false)} }
+
+	// Nothing is queued while connected.
+	if mt.queueAdd("", ip("192.0.2.1/32").Net, Duration(time.Hour), "") {
+		t.Fatalf("queueAdd() queued while not degraded")
+	}
+	mt.degraded.Store(true)
+	mt.queueAdd("", ip("192.0.2.1/32").Net, Duration(time.Hour), "first")
+	mt.queueAdd("blacklist", ip("192.0.2.2/32").Net, Duration(time.Hour), "")
+	mt.queueAdd("", ip("192.0.2.1/32").Net, Duration(time.Minute), "again")
+	mt.queueDel(ip("192.0.2.2/32"))
+	mt.queueAdd("other", ip("192.0.2.3/32").Net, Duration(time.Hour), "")
+	mt.queueAdd("", ip("192.0.2.4/32").Net, Duration(-time.Minute), "")
+
+	expect := []struct{ op, list, net string }{
+		{"add", "", "192.0.2.1/32"},
+		{"del", "", "192.0.2.2/32"},
+		{"add", "other", "192.0.2.3/32"},
+		{"add", "", "192.0.2.4/32"},
+	}
+	check := func(ops []queuedOp) {
+		t.Helper()
+		if len(ops) != len(expect) {
+			t.Fatalf("queue = %v, expected %v", ops, expect)
+		}
+		for i, d := range expect {
+			if ops[i].Op != d.op || ops[i].List != d.list || ops[i].Net != d.net {
+				t.Errorf("queue[%d] = %v, expected %v", i, ops[i], d)
+			}
+		}
+	}
+	check(mt.queue.ops)
+	// The longest lasting add is kept, with the last comment.
+	if d := time.Until(mt.queue.ops[0].Dead); d < 59*time.Minute || mt.queue.ops[0].Comment != "again" {
+		t.Errorf("queue[0] = %v, expected to last an hour", mt.queue.ops[0])
+	}
+
+	// The queue is saved later on, not for every change.
+	if _, err := os.Stat(statePath(mt.queue.file)); err == nil {
+		t.Errorf("queue saved right away, expected it to wait for a flush")
+	}
+	mt.queue.flush()
+
+	// The queue survives a restart.
+	mt2 := &Mikrotik{Name: "MT/1"}
+	if err := mt2.loadQueue(); err != nil {
+		t.Fatal(err)
+	}
+	check(mt2.queue.ops)
+
+	// Flushing fails without connection, leaving the queue intact.
+	if err := mt2.flushQueue(context.Background()); err == nil {
+		t.Errorf("flushQueue() succeeded without connection")
+	}
+	check(mt2.queue.ops)
+}
+
+func TestQueueDelIP(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	ip := BlackIP{Net: *parseCIDR("192.0.2.1/32", false), Dead: time.Now().Add(-time.Minute), ID: "*1"}
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist", dynlist: []BlackIP{ip}}
+	if err := mt.loadQueue(); err != nil {
+		t.Fatal(err)
+	}
+	mt.degraded.Store(true)
+
+	// A queued removal is done as far as the dynlist is concerned, so the
+	// expired entry is not removed over and over again.
+	if err := mt.DelIP(context.Background(), ip); err != nil {
+		t.Fatalf("DelIP() = %v, expected it to be queued", err)
+	}
+	if ips := mt.GetIPs(); len(ips) != 0 {
+		t.Errorf("GetIPs() = %v, expected the queued removal to be gone", ips)
+	}
+	if len(mt.queue.ops) != 1 || mt.queue.ops[0].Op != "del" {
+		t.Errorf("queue = %v, expected a single removal", mt.queue.ops)
+	}
+}
+
+func TestFlushQueue(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	go fakeRouter(t, l)
+	ctx := context.Background()
+	client, err := ros.DialContext(ctx, l.Addr().String(), "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	client.Async()
+
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist"}
+	if err := mt.loadQueue(); err != nil {
+		t.Fatal(err)
+	}
+	mt.degraded.Store(true)
+	mt.queueAdd("", *parseCIDR("192.0.2.1/32", false), Duration(time.Hour), "")
+	mt.queue.flush()
+
+	mt.client.Store(client)
+	if err := mt.flushQueue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if mt.Degraded() {
+		t.Errorf("Degraded() = true after flushQueue(), expected false")
+	}
+	// The emptied queue is saved right away, a restart does not apply
+	// the changes again.
+	mt2 := &Mikrotik{Name: "MT-1"}
+	if err := mt2.loadQueue(); err != nil {
+		t.Fatal(err)
+	}
+	if len(mt2.queue.ops) != 0 {
+		t.Errorf("saved queue = %v, expected it to be empty", mt2.queue.ops)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// historyFile is the name of the file in the state directory holding
+	// the ban history of repeat offenders.
+	historyFile = "history.json"
+	// maxTimeout is the longest timeout RouterOS accepts for an address
+	// list entry (35w3d13h13m56s). It is used for "permanent" bans of
+	// repeat offenders, as real permanent entries are reserved for the
+	// configured blacklist.
+	maxTimeout = Duration(35*7*24*time.Hour + 3*24*time.Hour + 13*time.Hour + 13*time.Minute + 56*time.Second)
+)
+
+// banRecord is the history of a single prefix. Count is the number of
+// times it got banned, Until the time the last ban ends.
+type banRecord struct {
+	Count int
+	Until time.Time
+}
+
+// banHistory keeps track of how often each prefix was banned by each jail,
+// so repeat offenders get longer bans. Jails are kept apart, as a running
+// ban of one jail says nothing about the blocktime of another. It is saved in the state directory, so it
+// survives restarts. Changes are saved once a second at most.
+type banHistory struct {
+	sync.Mutex
+	factor    float64
+	max       Duration
+	permanent int
+	forget    time.Duration
+	bans      map[string]*banRecord
+	dirty     bool
+}
+
+// recidive is the ban history, nil when escalating bans are disabled.
+var recidive *banHistory
+
+// loadHistory returns the ban history as saved in the state directory,
+// configured from the settings.
+func loadHistory() (*banHistory, error) {
+	h := &banHistory{
+		factor:    cfg.Settings.RecidiveFactor,
+		max:       cfg.Settings.RecidiveMax,
+		permanent: cfg.Settings.RecidivePermanent,
+		forget:    time.Duration(cfg.Settings.RecidiveForget),
+		bans:      make(map[string]*banRecord),
+	}
+	if err := loadState(historyFile, &h.bans); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// historyKey returns the key of the history of ip in the named jail.
+func historyKey(jail string, ip net.IPNet) string {
+	return jail + " " + ip.String()
+}
+
+// duration records a ban of key at time now and returns the blocktime to
+// use for it, based on how often it was banned before. Asking again while
+// the previous ban is still running is not seen as a repeat offence.
+func (h *banHistory) duration(key string, blocktime Duration, now time.Time) Duration {
+	h.Lock()
+	defer h.Unlock()
+
+	r, ok := h.bans[key]
+	if !ok {
+		r = &banRecord{}
+		h.bans[key] = r
+	}
+	if now.Before(r.Until) {
+		return Duration(r.Until.Sub(now))
+	}
+	d := h.escalate(blocktime, r.Count)
+	r.Count++
+	r.Until = now.Add(time.Duration(d))
+	h.dirty = true
+	if r.Count > 1 && (*debug || cfg.Settings.Verbose) {
+		log.Printf("%s: banned %d times, blocktime %s", key, r.Count, d)
+	}
+	return d
+}
+
+// run saves the history every second when it changed, until ctx is done.
+func (h *banHistory) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.save(now)
+		}
+	}
+}
+
+// save writes the history to the state directory when it changed,
+// forgetting about offenders which behaved for long enough at time now.
+func (h *banHistory) save(now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	if !h.dirty {
+		return
+	}
+	for k, v := range h.bans {
+		if now.Sub(v.Until) > h.forget {
+			delete(h.bans, k)
+		}
+	}
+	if err := saveState(historyFile, h.bans); err != nil {
+		log.Printf("Unable to save ban history: %v", err)
+	} else {
+		h.dirty = false
+	}
+}
+
+// escalate returns the blocktime for a prefix banned count times before.
+func (h *banHistory) escalate(blocktime Duration, count int) Duration {
+	if h.permanent > 0 && count+1 >= h.permanent {
+		return maxTimeout
+	}
+	d := float64(blocktime) * math.Pow(h.factor, float64(count))
+	if d >= float64(h.max) {
+		return h.max
+	}
+	return Duration(d)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecidive(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	cfg.Settings.RecidiveFactor = 2
+	cfg.Settings.RecidiveMax = Duration(5 * time.Hour)
+	cfg.Settings.RecidivePermanent = 5
+	cfg.Settings.RecidiveForget = Duration(24 * time.Hour)
+	defer func() { cfg = Config{} }()
+
+	h, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testdata := []struct {
+		offset time.Duration
+		expect Duration
+	}{
+		{0, Duration(time.Hour)},
+		// Still banned, no escalation.
+		{30 * time.Minute, Duration(30 * time.Minute)},
+		{2 * time.Hour, Duration(2 * time.Hour)},
+		{5 * time.Hour, Duration(4 * time.Hour)},
+		// Capped by recidivemax.
+		{10 * time.Hour, Duration(5 * time.Hour)},
+		// Fifth ban is permanent.
+		{16 * time.Hour, maxTimeout},
+	}
+	for _, d := range testdata {
+		if got := h.duration("1.2.3.4/32", Duration(time.Hour), start.Add(d.offset)); got != d.expect {
+			t.Errorf("duration(+%s) = %s, expected %s", d.offset, got, d.expect)
+		}
+	}
+
+	// Bans do not write the history themselves.
+	if h2, err := loadHistory(); err != nil || len(h2.bans) != 0 {
+		t.Fatalf("history saved before save(): %v, %v", h2, err)
+	}
+	// The history survives a restart, once saved.
+	h.save(start.Add(16 * time.Hour))
+	h, err = loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := h.bans["1.2.3.4/32"]; r == nil || r.Count != 5 {
+		t.Fatalf("reloaded history = %+v, expected 5 bans", r)
+	}
+
+	// And forgets about offenders which behaved for long enough.
+	later := start.Add(16*time.Hour + time.Duration(maxTimeout) + 25*time.Hour)
+	if got := h.duration("5.6.7.8/32", Duration(time.Hour), later); got != Duration(time.Hour) {
+		t.Errorf("duration() = %s, expected %s", got, Duration(time.Hour))
+	}
+	h.save(later)
+	if _, ok := h.bans["1.2.3.4/32"]; ok {
+		t.Errorf("expected 1.2.3.4/32 to be forgotten")
+	}
+}
+
+func TestRecidiveJails(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	cfg.Settings.RecidiveFactor = 2
+	cfg.Settings.RecidiveMax = Duration(4 * 7 * 24 * time.Hour)
+	cfg.Settings.RecidiveForget = Duration(24 * time.Hour)
+	defer func() { cfg = Config{} }()
+
+	h, err := loadHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ip := *parseCIDR("1.2.3.4", false)
+	sshd, asterisk := Duration(8*time.Hour), Duration(7*24*time.Hour)
+	testdata := []struct {
+		jail      string
+		offset    time.Duration
+		blocktime Duration
+		expect    Duration
+	}{
+		{"sshd", 0, sshd, sshd},
+		// Another jail banning during the sshd ban keeps its own week.
+		{"asterisk", 7 * time.Hour, asterisk, asterisk},
+		// Each jail escalates its own bans.
+		{"sshd", 8 * time.Hour, sshd, 2 * sshd},
+		{"asterisk", 7*24*time.Hour + 7*time.Hour, asterisk, 2 * asterisk},
+	}
+	for _, d := range testdata {
+		if got := h.duration(historyKey(d.jail, ip), d.blocktime, start.Add(d.offset)); got != d.expect {
+			t.Errorf("duration(%s, +%s) = %s, expected %s", d.jail, d.offset, got, d.expect)
+		}
+	}
+}
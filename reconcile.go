@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// resync rereads the dynamic entries of the managed address lists from the
+// Mikrotik, replacing the dynlist. It returns the number of entries which
+// disappeared from the Mikrotik, like when deleted by hand or lost in a
+// reboot, and the number of entries it had which we did not know about.
+func (mt *Mikrotik) resync(ctx context.Context) (lost, found int, err error) {
+	// Keep AddIP/DelIP from changing the lists while we read them.
+	mt.lock.Lock()
+	defer mt.lock.Unlock()
+
+	var all []BlackIP
+	for _, l := range append([]string{mt.banlist}, mt.lists...) {
+		list, err := mt.getAddresslist(ctx, l)
+		if err != nil {
+			return 0, 0, err
+		}
+		all = append(all, list...)
+	}
+
+	now := time.Now()
+	mt.Lock()
+	// Only our own entries, and those added by hand we track since.
+	known := make(map[string]bool)
+	for _, v := range mt.dynlist {
+		known[familyID(v.Net.IP.To4() == nil, v.ID)] = true
+	}
+	var ips []BlackIP
+	have := make(map[string]bool)
+	for _, v := range all {
+		if !v.Dead.IsZero() && (v.ours() || known[familyID(v.Net.IP.To4() == nil, v.ID)]) {
+			ips = append(ips, v)
+			have[v.List+" "+v.Net.String()] = true
+		}
+	}
+	sort.Sort(ByAge(ips))
+	for _, v := range mt.dynlist {
+		key := v.List + " " + v.Net.String()
+		if have[key] {
+			delete(have, key)
+		} else if v.Dead.After(now) {
+			lost++
+		}
+	}
+	found = len(have)
+	mt.dynlist = ips
+	mt.Unlock()
+
+	if cfg.Settings.AutoDelete {
+		// The dynlist changed underneath the auto deleter.
+		select {
+		case mt.hasData <- struct{}{}:
+		default:
+		}
+	}
+	return lost, found, nil
+}
+
+// syncIPs returns the dynamic entries of the Mikrotik to share with the
+// others. Aggregates are replaced by their live members, as the aggregate
+// may cover members of jails not applying to every Mikrotik.
+func (mt *Mikrotik) syncIPs() []BlackIP {
+	now := time.Now()
+	mt.RLock()
+	defer mt.RUnlock()
+	var ips []BlackIP
+	for _, v := range mt.dynlist {
+		if v.Comment == nil || v.Comment.Rule != aggregateRule {
+			ips = append(ips, v)
+		}
+	}
+	for _, a := range mt.aggregates {
+		for _, v := range a.members {
+			if v.Dead.After(now) {
+				ips = append(ips, v)
+			}
+		}
+	}
+	return ips
+}
+
+// wants reports whether the entry belongs on the Mikrotik: it manages the
+// address list of the entry and the jail banning it, if any, bans on it.
+// Bans of local jails stay on the Mikrotik which sent the message, and
+// aggregates are formed by every Mikrotik on its own.
+func (mt *Mikrotik) wants(ip BlackIP) bool {
+	if ip.List != "" && !mt.manages(ip.List) {
+		return false
+	}
+	if ip.Comment == nil {
+		// Added by hand, belongs on every Mikrotik.
+		return true
+	}
+	if ip.Comment.Rule == aggregateRule {
+		return false
+	}
+	if j := cfg.jailOf(ip.Comment.Rule); j != nil {
+		return !j.local && j.appliesTo(mt.Name)
+	}
+	return true
+}
+
+// syncDynlists adds the dynamic entries of every Mikrotik, and the active
+// bans of the ban database, to the Mikrotiks wanting them which miss them,
+// with their remaining lifetime. When several have the same entry, the
+// longest living one is used.
+func syncDynlists(ctx context.Context, mts []*Mikrotik) {
+	merged := make(map[string]BlackIP)
+	sources := [][]BlackIP{bans.active()}
+	for _, mt := range mts {
+		sources = append(sources, mt.syncIPs())
+	}
+	for _, ips := range sources {
+		for _, ip := range ips {
+			key := ip.List + " " + ip.Net.String()
+			if v, ok := merged[key]; !ok || ip.Dead.After(v.Dead) {
+				merged[key] = ip
+			}
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, mt := range mts {
+		have := mt.GetIPs()
+		var missing []ban
+	merged:
+		for _, ip := range merged {
+			if !mt.wants(ip) {
+				continue
+			}
+			// Covered by an aggregate counts as well.
+			for _, v := range have {
+				if v.List == ip.List && covers(v.Net, ip.Net) {
+					continue merged
+				}
+			}
+			if d := time.Until(ip.Dead); d >= time.Second {
+				c := ip.Comment
+				if c == nil {
+					c = newComment("manual", time.Now(), 1)
+				}
+				missing = append(missing, ban{ip.List, ip.Net, Duration(d.Truncate(time.Second)), c.String()})
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if cfg.Settings.Verbose {
+			log.Printf("%s: adding %d entries missing compared to the others", mt.Name, len(missing))
+		}
+		// Add them concurrently, a slow Mikrotik should not delay the others.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mt.applyBans(ctx, missing)
+		}()
+	}
+	wg.Wait()
+}
+
+// reconcile rereads the address lists of every connected Mikrotik,
+// reporting any drift from what we expected, and adds the entries missing
+// on one of them from the others.
+func reconcile(ctx context.Context, mts []*Mikrotik) {
+	var healthy []*Mikrotik
+	for _, mt := range mts {
+		if mt.Degraded() {
+			// Resynchronized after reconnecting anyway.
+			continue
+		}
+		lost, found, err := mt.resync(ctx)
+		if err != nil {
+			log.Printf("%s: reconcile: %v", mt.Name, err)
+			continue
+		}
+		if lost != 0 || found != 0 {
+			mt.drift.Add(int64(lost + found))
+			log.Printf("%s: reconcile: %d entries were removed from the Mikrotik, %d unknown entries were found", mt.Name, lost, found)
+		}
+		healthy = append(healthy, mt)
+	}
+	syncDynlists(ctx, healthy)
+}
+
+// runReconcile reconciles the Mikrotiks every interval, until ctx is done.
+func runReconcile(ctx context.Context, mts []*Mikrotik, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reconcile(ctx, mts)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSyncDynlists(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	entry := func(s, list string, d time.Duration) BlackIP {
+		_, ip, _ := net.ParseCIDR(s)
+		return BlackIP{Net: *ip, Dead: time.Now().Add(d), List: list}
+	}
+	// Both are degraded, so the missing entries end up in their queues.
+	mt1 := &Mikrotik{Name: "MT-1", banlist: "blacklist", dynlist: []BlackIP{
+		entry("192.0.2.1/32", "", time.Hour),
+		entry("192.0.2.3/32", "", time.Hour),
+	}}
+	mt2 := &Mikrotik{Name: "MT-2", banlist: "blacklist", lists: []string{"voip"}, dynlist: []BlackIP{
+		entry("192.0.2.2/32", "", time.Hour),
+		entry("192.0.2.3/32", "", 2*time.Hour),
+		entry("192.0.2.4/32", "voip", time.Hour),
+	}}
+	for _, mt := range []*Mikrotik{mt1, mt2} {
+		mt.queue.file = queueFile(mt.Name)
+		mt.degraded.Store(true)
+	}
+	syncDynlists(context.Background(), []*Mikrotik{mt1, mt2})
+
+	// The voip list is not managed by MT-1.
+	if len(mt1.queue.ops) != 1 || mt1.queue.ops[0].Net != "192.0.2.2/32" {
+		t.Errorf("MT-1 queue = %v, expected only 192.0.2.2/32", mt1.queue.ops)
+	}
+	if len(mt2.queue.ops) != 1 || mt2.queue.ops[0].Net != "192.0.2.1/32" {
+		t.Errorf("MT-2 queue = %v, expected only 192.0.2.1/32", mt2.queue.ops)
+	}
+}
+
+func TestSyncDynlistsJails(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+	cfg.jails = []*jail{
+		{name: "sip", mikrotik: map[string]bool{"voice-edge": true}},
+		{name: "local", local: true},
+		{name: "sshd"},
+	}
+
+	entry := func(s, rule string) BlackIP {
+		_, ip, _ := net.ParseCIDR(s)
+		return BlackIP{Net: *ip, Dead: time.Now().Add(time.Hour), Comment: newComment(rule, time.Now(), 1)}
+	}
+	aggr := entry("198.51.100.0/24", aggregateRule)
+	edge := &Mikrotik{Name: "voice-edge", banlist: "blacklist", dynlist: []BlackIP{
+		entry("192.0.2.1/32", "sip"),
+		entry("192.0.2.2/32", "local"),
+		entry("192.0.2.3/32", "sshd"),
+		aggr,
+	}, aggregates: map[string]*aggregate{
+		" " + aggr.Net.String(): {net: aggr.Net, members: []BlackIP{
+			entry("198.51.100.1/32", "sip"),
+			entry("198.51.100.2/32", "sshd"),
+		}},
+	}}
+	core := &Mikrotik{Name: "core", banlist: "blacklist"}
+	for _, mt := range []*Mikrotik{edge, core} {
+		mt.queue.file = queueFile(mt.Name)
+		mt.degraded.Store(true)
+	}
+	syncDynlists(context.Background(), []*Mikrotik{edge, core})
+
+	// Only the sshd bans reach the core, not the aggregate itself.
+	got := make(map[string]bool)
+	for _, op := range core.queue.ops {
+		got[op.Net] = true
+	}
+	if len(got) != 2 || !got["192.0.2.3/32"] || !got["198.51.100.2/32"] {
+		t.Errorf("core queue = %v, expected only the sshd bans", core.queue.ops)
+	}
+	if len(edge.queue.ops) != 0 {
+		t.Errorf("voice-edge queue = %v, expected nothing", edge.queue.ops)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whitelists holds the whitelist of every configured Mikrotik, as far as
+// it can be known without talking to the Mikrotik. References to address
+// lists (@name) can not be resolved offline and are kept in unresolved.
+type whitelists struct {
+	names      []string
+	nets       map[string][]net.IPNet
+	unresolved map[string][]string
+}
+
+// newWhitelists builds the offline whitelists from the configuration.
+func newWhitelists(c *Config) *whitelists {
+	wl := &whitelists{
+		nets:       make(map[string][]net.IPNet),
+		unresolved: make(map[string][]string),
+	}
+	for k, v := range c.Mikrotik {
+		if v.Disabled {
+			continue
+		}
+		wl.names = append(wl.names, k)
+		for _, w := range v.Whitelist {
+			if strings.HasPrefix(w, "@") {
+				wl.unresolved[k] = append(wl.unresolved[k], w)
+			} else if ip := parseCIDR(w, false); ip != nil {
+				wl.nets[k] = append(wl.nets[k], *ip)
+			}
+		}
+	}
+	sort.Strings(wl.names)
+	return wl
+}
+
+// lookup returns the whitelist entry of the named Mikrotik overlapping ip,
+// or nil when it is not whitelisted (as far as we know).
+func (wl *whitelists) lookup(name string, ip net.IPNet) *net.IPNet {
+	for _, w := range wl.nets[name] {
+		if overlaps(w, ip) {
+			return &w
+		}
+	}
+	return nil
+}
+
+// lineMessage returns the message of a line read from a log file. Lines
+// that look like raw syslog messages are parsed as such, anything else is
+// taken as is. The time of other lines is taken from a leading syslog or
+// RFC 3339 timestamp, like those of /var/log/auth.log.
+func lineMessage(line string) *message {
+	if strings.HasPrefix(line, "<") {
+		if msg, err := parseSyslog([]byte(line), "localhost:0"); err == nil {
+			return msg
+		}
+	}
+	msg := textMessage(line)
+	msg.Time = lineTime(line)
+	return msg
+}
+
+// lineTime returns the timestamp the line starts with, zero when there is
+// none. Syslog timestamps lack the year and zone, like the syslog parser
+// the current year and UTC are assumed.
+func lineTime(line string) time.Time {
+	if len(line) >= len(time.Stamp) {
+		if t, err := time.ParseInLocation(time.Stamp, line[:len(time.Stamp)], time.UTC); err == nil {
+			return t.AddDate(time.Now().Year(), 0, 0)
+		}
+	}
+	first, _, _ := strings.Cut(line, " ")
+	if t, err := time.Parse(time.RFC3339Nano, first); err == nil {
+		return t
+	}
+	return time.Time{}
+}
+
+// replayReport holds the counters gathered while replaying a log file.
+type replayReport struct {
+	lines       int
+	matched     int
+	perRE       map[*jail][]int
+	ips         map[string]int
+	whitelisted map[string]int
+	ignored     map[string]int
+	unparsable  map[string]int
+	pending     map[string]int
+	untimed     int
+}
+
+// replayFile replays the named file, or stdin when it is "-", and writes
+// the report to stdout.
+func replayFile(name string) error {
+	if name == "-" {
+		return replay(os.Stdin, os.Stdout)
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	return replay(f, os.Stdout)
+}
+
+// replay runs every line read from r through the same parsing, matching
+// and maxretry counting as the live receive loop does, without talking to
+// any Mikrotik, and writes a report of the would-be bans to w. Lines can be
+// either raw syslog messages or plain log lines. Hits are counted at the
+// time of their line, lines without a timestamp count as received together
+// with the line before.
+func replay(r io.Reader, w io.Writer) error {
+	rep := replayReport{
+		perRE:       make(map[*jail][]int),
+		ips:         make(map[string]int),
+		whitelisted: make(map[string]int),
+		ignored:     make(map[string]int),
+		unparsable:  make(map[string]int),
+		pending:     make(map[string]int),
+	}
+	wl := newWhitelists(&cfg)
+	// Fresh counters, so replaying leaves those of the jails alone.
+	hits := make(map[*jail]*hitCounter)
+	for _, j := range cfg.jails {
+		rep.perRE[j] = make([]int, j.rules())
+		if j.hits != nil {
+			hits[j] = newHitCounter(j.maxretry, j.hits.findtime, j.hits.size)
+		}
+	}
+	now := time.Time{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFrameSize)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		rep.lines++
+		msg := lineMessage(line)
+		ms := cfg.match(msg)
+		if len(ms) == 0 {
+			continue
+		}
+		switch {
+		case !msg.Time.IsZero():
+			now = msg.Time
+		case now.IsZero():
+			now = time.Now()
+			fallthrough
+		default:
+			rep.untimed++
+		}
+		rep.matched++
+		for _, m := range ms {
+			rep.perRE[m.Jail][m.Index]++
+			if m.IP == nil {
+				rep.unparsable[strconv.Quote(m.Groups["IP"])]++
+				continue
+			}
+			if m.Ignore != nil {
+				rep.ignored[fmt.Sprintf("%s (%s)", m.IP, m.Ignore.String())]++
+				continue
+			}
+			if h := hits[m.Jail]; h != nil {
+				if _, ban := h.hit(m.IP.String(), now); !ban {
+					continue
+				}
+			}
+			banned := false
+			for _, name := range wl.names {
+				if !m.Jail.appliesTo(name) {
+					continue
+				}
+				if e := wl.lookup(name, *m.IP); e != nil {
+					rep.whitelisted[fmt.Sprintf("%s on %s (%s)", m.IP, name, e)]++
+				} else {
+					banned = true
+				}
+			}
+			if banned {
+				rep.ips[m.IP.String()]++
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	for j, h := range hits {
+		for k, n := range h.pending() {
+			rep.pending[fmt.Sprintf("%s (%s, %d/%d)", k, j.name, n, j.maxretry)] = n
+		}
+	}
+
+	rep.write(w, wl)
+	return nil
+}
+
+// write prints the report in a human readable form.
+func (rep *replayReport) write(w io.Writer, wl *whitelists) {
+	_, _ = fmt.Fprintf(w, "Lines read:    %d\n", rep.lines)
+	_, _ = fmt.Fprintf(w, "Lines matched: %d\n", rep.matched)
+	_, _ = fmt.Fprintf(w, "\nHits per regexp:\n")
+	for _, j := range cfg.jails {
+		for i, n := range rep.perRE[j] {
+			_, _ = fmt.Fprintf(w, "  %s#%d %6d  %s\n", j.name, i, n, j.rule(i))
+		}
+	}
+	for _, j := range cfg.jails {
+		if j.hits != nil {
+			_, _ = fmt.Fprintf(w, "\nJail %s bans after %d hits within %s.\n", j.name, j.maxretry, j.hits.findtime)
+		}
+	}
+	if rep.untimed != 0 {
+		_, _ = fmt.Fprintf(w, "\nNote: %d matching lines had no timestamp, their hits count as received together with the line before.\n", rep.untimed)
+	}
+	writeCounts(w, "Would be banned", rep.ips)
+	writeCounts(w, "Below maxretry", rep.pending)
+	writeCounts(w, "Suppressed by whitelist", rep.whitelisted)
+	writeCounts(w, "Suppressed by ignore-re", rep.ignored)
+	writeCounts(w, "Unparsable IP captures", rep.unparsable)
+	for _, name := range wl.names {
+		if len(wl.unresolved[name]) != 0 {
+			_, _ = fmt.Fprintf(w, "\nNote: %s whitelists %s, which can not be checked offline.\n", name, strings.Join(wl.unresolved[name], ", "))
+		}
+	}
+}
+
+// writeCounts prints a section of the report, most frequent first.
+func writeCounts(w io.Writer, title string, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	_, _ = fmt.Fprintf(w, "\n%s: %d\n", title, len(keys))
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "  %6d  %s\n", counts[k], k)
+	}
+}
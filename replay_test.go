@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const replayConfig = `
+[regexps]
+ re = "Failed password for(?: invalid user)? (?P<USER>\\S+) from (?P<IP>\\S+) port \\d+ ssh2"
+ ignore-re = "USER =~ ^nagios$"
+ test-ignore = "Failed password for nagios from 60.173.26.187 port 8962 ssh2"
+
+[Mikrotik "MT-1"]
+ address = 1.2.3.4
+ user = user
+ passwd = passwd
+ whitelist = 192.168.10.0/24
+ whitelist = @admins
+`
+
+func TestReplay(t *testing.T) {
+	var err error
+	cfg, err = newConfigString(replayConfig, 0, 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := strings.Join([]string{
+		"<38>Oct 11 22:14:15 host sshd[123]: Failed password for root from 60.173.26.187 port 8962 ssh2",
+		"Oct 11 22:14:16 host sshd[123]: Failed password for root from 60.173.26.187 port 8963 ssh2",
+		"Oct 11 22:14:17 host sshd[123]: Failed password for invalid user admin from 192.168.10.5 port 8962 ssh2",
+		"Oct 11 22:14:18 host sshd[123]: Failed password for root from bogus port 8962 ssh2",
+		"Oct 11 22:14:19 host sshd[123]: Failed password for nagios from 60.173.26.188 port 8962 ssh2",
+		"Oct 11 22:14:20 host sshd[123]: Accepted password for root from 60.173.26.187 port 8962 ssh2",
+	}, "\n")
+	var out bytes.Buffer
+	if err = replay(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"Lines read:    6\n",
+		"Lines matched: 5\n",
+		"  default#0      5  Failed password",
+		"Would be banned: 1\n       2  60.173.26.187/32\n",
+		"Suppressed by whitelist: 1\n       1  192.168.10.5/32 on MT-1 (192.168.10.0/24)\n",
+		"Suppressed by ignore-re: 1\n       1  60.173.26.188/32 (USER =~ ^nagios$)\n",
+		"Unparsable IP captures: 1\n       1  \"bogus\"\n",
+		"Note: MT-1 whitelists @admins",
+	} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("replay() output does not contain %q\n---\n%s---\n", expect, out.String())
+		}
+	}
+}
+
+func TestReplayMaxRetry(t *testing.T) {
+	var err error
+	cfg, err = newConfigString("[settings]\n maxretry = 2\n"+replayConfig, 0, 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := strings.Join([]string{
+		"Failed password for root from 60.173.26.187 port 8962 ssh2",
+		"Failed password for root from 60.173.26.189 port 8962 ssh2",
+		"Failed password for root from 60.173.26.187 port 8963 ssh2",
+		"Failed password for root from 60.173.26.187 port 8964 ssh2",
+	}, "\n")
+	var out bytes.Buffer
+	if err = replay(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"Jail default bans after 2 hits within 10m0s",
+		// Only every second hit bans, just like live.
+		"Would be banned: 1\n       1  60.173.26.187/32\n",
+		"Below maxretry: 2\n       1  60.173.26.187/32 (default, 1/2)\n       1  60.173.26.189/32 (default, 1/2)\n",
+	} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("replay() output does not contain %q\n---\n%s---\n", expect, out.String())
+		}
+	}
+}
+
+func TestReplayFindTime(t *testing.T) {
+	var err error
+	cfg, err = newConfigString("[settings]\n maxretry = 2\n findtime = 10m\n"+replayConfig, 0, 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := strings.Join([]string{
+		"<38>Oct 11 10:00:00 host sshd[123]: Failed password for root from 60.173.26.187 port 8962 ssh2",
+		"Oct 11 10:00:00 host sshd[123]: Failed password for root from 60.173.26.189 port 8962 ssh2",
+		"<38>Oct 11 10:05:00 host sshd[123]: Failed password for root from 60.173.26.189 port 8962 ssh2",
+		// Too late to count along with the first.
+		"Oct 11 10:30:00 host sshd[123]: Failed password for root from 60.173.26.187 port 8963 ssh2",
+		// No timestamp, counts as received at 10:30.
+		"Failed password for root from 60.173.26.190 port 8963 ssh2",
+	}, "\n")
+	var out bytes.Buffer
+	if err = replay(strings.NewReader(in), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, expect := range []string{
+		"Would be banned: 1\n       1  60.173.26.189/32\n",
+		"Below maxretry: 2\n       1  60.173.26.187/32 (default, 1/2)\n       1  60.173.26.190/32 (default, 1/2)\n",
+		"Note: 1 matching lines had no timestamp",
+	} {
+		if !strings.Contains(out.String(), expect) {
+			t.Errorf("replay() output does not contain %q\n---\n%s---\n", expect, out.String())
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net"
+)
+
+// resolveSources returns the addresses syslog messages of the Mikrotik
+// come from: the address we connect to and any configured source
+// addresses. Hostnames are resolved once, at startup.
+func resolveSources(name string, c *ConfigMikrotik) []net.IP {
+	hosts := c.Source
+	if host, _, err := net.SplitHostPort(c.Address); err == nil {
+		hosts = append([]string{host}, hosts...)
+	}
+	var ips []net.IP
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+			continue
+		}
+		addrs, err := net.LookupIP(host)
+		if err != nil {
+			log.Printf("%s: unable to resolve source %s: %v", name, host, err)
+			continue
+		}
+		ips = append(ips, addrs...)
+	}
+	return ips
+}
+
+// senderMikrotik returns the Mikrotik a message came from, by comparing
+// the source address of the sender against the addresses of every
+// Mikrotik. It returns nil when the sender is not one of them.
+func senderMikrotik(mts []*Mikrotik, from string) *Mikrotik {
+	host, _, err := net.SplitHostPort(from)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	for _, mt := range mts {
+		for _, src := range mt.sources {
+			if src.Equal(ip) {
+				return mt
+			}
+		}
+	}
+	return nil
+}
+
+// isOwnAddress reports whether prefix covers any address of this host.
+func isOwnAddress(prefix net.IPNet) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && prefix.Contains(ipnet.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiUserFailure checks whether a match is a failed login of the user we
+// log in to the Mikrotiks with, which could be us using the wrong
+// password. Those are logged, and reported true when they came from this
+// host, so we never ban ourselves. The sender is nil when the message did
+// not come from a Mikrotik, in which case all of them are checked.
+func apiUserFailure(mts []*Mikrotik, sender *Mikrotik, m *match) bool {
+	user := m.Groups["USER"]
+	if user == "" {
+		return false
+	}
+	for _, mt := range mts {
+		if (sender != nil && mt != sender) || mt.User != user {
+			continue
+		}
+		if isOwnAddress(*m.IP) {
+			log.Printf("%s: %s: login failure for our API user %q from this host, check its passwd; not banning %s\n", mt.Name, m.Jail.name, user, m.IP)
+			return true
+		}
+		log.Printf("%s: %s: login failure for our API user %q from %s\n", mt.Name, m.Jail.name, user, m.IP)
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSenderMikrotik(t *testing.T) {
+	mts := []*Mikrotik{
+		{Name: "MT-1", sources: resolveSources("MT-1", &ConfigMikrotik{Address: "192.0.2.1:8728"})},
+		{Name: "MT-2", sources: resolveSources("MT-2", &ConfigMikrotik{Address: "192.0.2.2:8728", Source: []string{"2001:db8::2"}})},
+	}
+	testdata := []struct {
+		from   string
+		expect string
+	}{
+		{"192.0.2.1:514", "MT-1"},
+		{"192.0.2.2:514", "MT-2"},
+		{"[2001:db8::2]:514", "MT-2"},
+		{"192.0.2.3:514", ""},
+		{"/var/log/auth.log", ""},
+	}
+	for _, d := range testdata {
+		got := ""
+		if mt := senderMikrotik(mts, d.from); mt != nil {
+			got = mt.Name
+		}
+		if got != d.expect {
+			t.Errorf("senderMikrotik(%s) = %q, expected %q", d.from, got, d.expect)
+		}
+	}
+}
+
+func TestAPIUserFailure(t *testing.T) {
+	mts := []*Mikrotik{{Name: "MT-1", User: "fwban"}, {Name: "MT-2", User: "other"}}
+	testdata := []struct {
+		user   string
+		ip     string
+		sender *Mikrotik
+		expect bool
+	}{
+		{"fwban", "127.0.0.1/32", mts[0], true},
+		{"fwban", "127.0.0.1/32", nil, true},
+		{"fwban", "127.0.0.1/32", mts[1], false},
+		{"fwban", "192.0.2.1/32", mts[0], false},
+		{"admin", "127.0.0.1/32", mts[0], false},
+	}
+	for _, d := range testdata {
+		_, ip, _ := net.ParseCIDR(d.ip)
+		m := &match{Jail: &jail{name: "routeros"}, Groups: map[string]string{"USER": d.user}, IP: ip}
+		if got := apiUserFailure(mts, d.sender, m); got != d.expect {
+			t.Errorf("apiUserFailure(%s, %s) = %t, expected %t", d.user, d.ip, got, d.expect)
+		}
+	}
+}
+
+func TestParseBare(t *testing.T) {
+	m, err := parseSyslog([]byte("<86>system,error,critical login failure for user admin from 192.0.2.1 via winbox"), "192.0.2.1:514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Hostname != "192.0.2.1" || m.Facility != 10 || m.Severity != 6 || m.Text != "system,error,critical login failure for user admin from 192.0.2.1 via winbox" {
+		t.Errorf("parseSyslog() = %+v", m)
+	}
+	for _, s := range []string{"<999>text", "no pri", "<86> "} {
+		if m, err := parseSyslog([]byte(s), "192.0.2.1:514"); err == nil {
+			t.Errorf("parseSyslog(%q) = %+v, expected an error", s, m)
+		}
+	}
+}
+
+func TestTLSSender(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCert(t, "fwban test CA", nil, nil)
+	server, serverKey := testCert(t, "fwban", ca, caKey)
+	client, clientKey := testCert(t, "gw1", ca, caKey)
+	tc, err := newTLSConfig(writePEM(t, dir, "server.crt", server, nil), writePEM(t, dir, "server.key", nil, serverKey), writePEM(t, dir, "ca.crt", ca, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &dispatcher{inbox: make(chan inbound, 1)}
+	go serveTCP(ctx, l, d)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte("<86>system,error,critical login failure for user admin from 192.0.2.9 via winbox\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	var in inbound
+	select {
+	case in = <-d.inbox:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	// A router sending over TLS is still recognized by its address.
+	mts := []*Mikrotik{{Name: "MT-1", sources: resolveSources("MT-1", &ConfigMikrotik{Address: "127.0.0.1:8728"})}}
+	if mt := senderMikrotik(mts, in.from); mt != mts[0] {
+		t.Errorf("senderMikrotik(%s) = %v, expected MT-1", in.from, mt)
+	}
+	m, err := parseSyslog(in.pkt, in.from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Hostname != "127.0.0.1" {
+		t.Errorf("parseSyslog(%s).Hostname = %q, expected 127.0.0.1", in.from, m.Hostname)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// structuredData is the structured data of a RFC 5424 message, the params
+// of each element indexed by its SD-ID.
+type structuredData map[string]map[string]string
+
+// parseStructuredData parses the STRUCTURED-DATA part of a RFC 5424
+// message, like `[auth@32473 src="1.2.3.4" result="fail"]`. A NILVALUE
+// gives no elements.
+func parseStructuredData(s string) (structuredData, error) {
+	sd := make(structuredData)
+	if s == "" || s == "-" {
+		return sd, nil
+	}
+	for len(s) != 0 {
+		if s[0] != '[' {
+			return nil, fmt.Errorf("expected '[' at %q", s)
+		}
+		i := strings.IndexAny(s, " ]")
+		if i < 2 {
+			return nil, fmt.Errorf("missing SD-ID at %q", s)
+		}
+		id, params := s[1:i], make(map[string]string)
+		s = s[i:]
+		for s[0] == ' ' {
+			i = strings.Index(s, "=\"")
+			if i < 2 {
+				return nil, fmt.Errorf("bad SD-PARAM at %q", s)
+			}
+			name := s[1:i]
+			s = s[i+2:]
+			var value strings.Builder
+			for {
+				if len(s) == 0 {
+					return nil, fmt.Errorf("unterminated value of %s/%s", id, name)
+				}
+				if s[0] == '"' {
+					break
+				}
+				// Only '"', '\' and ']' are escaped, any other backslash
+				// is taken as is.
+				if s[0] == '\\' && len(s) > 1 && strings.IndexByte(`"\]`, s[1]) >= 0 {
+					s = s[1:]
+				}
+				value.WriteByte(s[0])
+				s = s[1:]
+			}
+			params[name] = value.String()
+			s = s[1:]
+			if len(s) == 0 {
+				return nil, fmt.Errorf("unterminated element %s", id)
+			}
+		}
+		if s[0] != ']' {
+			return nil, fmt.Errorf("expected ']' at %q", s)
+		}
+		sd[id] = params
+		s = s[1:]
+	}
+	return sd, nil
+}
+
+// sdRule takes the IP from the param of a structured data element, given
+// the other conditions on the params hold.
+type sdRule struct {
+	id, param string
+	conds     []fieldCond
+}
+
+// splitSDPath splits a "SD-ID/param" reference.
+func splitSDPath(s string) (string, string, bool) {
+	i := strings.LastIndex(s, "/")
+	if i <= 0 || i == len(s)-1 {
+		return "", "", false
+	}
+	return s[:i], s[i+1:], true
+}
+
+// newSDRule parses an sd-ip reference and its sd-match conditions.
+// Conditions on a bare param refer to the element holding the IP.
+func newSDRule(ip string, conds []string) (*sdRule, error) {
+	id, param, ok := splitSDPath(ip)
+	if !ok {
+		return nil, fmt.Errorf("sd-ip must be of the form SD-ID/param, not %q", ip)
+	}
+	r := &sdRule{id: id, param: param}
+	for _, s := range conds {
+		fc, err := newFieldCond(s)
+		if err != nil {
+			return nil, fmt.Errorf("sd-match: %w", err)
+		}
+		if !strings.Contains(fc.field, "/") {
+			fc.field = id + "/" + fc.field
+		}
+		r.conds = append(r.conds, fc)
+	}
+	return r, nil
+}
+
+// match returns the params of the element holding the IP, with the IP
+// itself as `IP`, when all conditions hold.
+func (r *sdRule) match(msg *message) map[string]string {
+	params, ok := msg.SD[r.id]
+	if !ok {
+		return nil
+	}
+	ip, ok := params[r.param]
+	if !ok {
+		return nil
+	}
+	for _, fc := range r.conds {
+		id, param, _ := splitSDPath(fc.field)
+		v, ok := msg.SD[id][param]
+		if !fc.match(v, ok) {
+			return nil
+		}
+	}
+	groups := map[string]string{"IP": ip}
+	for k, v := range params {
+		if k != "IP" {
+			groups[k] = v
+		}
+	}
+	return groups
+}
+
+// String describes the rule.
+func (r *sdRule) String() string {
+	return "sd-ip " + r.id + "/" + r.param
+}
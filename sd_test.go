@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStructuredData(t *testing.T) {
+	testdata := []struct {
+		str    string
+		expect structuredData
+		ok     bool
+	}{
+		{"-", structuredData{}, true},
+		{`[auth@32473 src="1.2.3.4" result="fail"]`, structuredData{"auth@32473": {"src": "1.2.3.4", "result": "fail"}}, true},
+		{`[a@1 v="x\"y\]z\\"][b@1]`, structuredData{"a@1": {"v": `x"y]z\`}, "b@1": {}}, true},
+		{`[a@1 v="\n"]`, structuredData{"a@1": {"v": `\n`}}, true},
+		{`[a@1 v="x"`, nil, false},
+		{`[a@1 v="x]`, nil, false},
+		{`[a@1 v=x]`, nil, false},
+		{`a@1`, nil, false},
+	}
+	for _, d := range testdata {
+		sd, err := parseStructuredData(d.str)
+		if (err == nil) != d.ok {
+			t.Errorf("parseStructuredData(%s) error = %v, expected ok %t", d.str, err, d.ok)
+			continue
+		}
+		if d.ok && !reflect.DeepEqual(sd, d.expect) {
+			t.Errorf("parseStructuredData(%s) = %v, expected %v", d.str, sd, d.expect)
+		}
+	}
+}
+
+func TestSDRule(t *testing.T) {
+	r, err := newSDRule("auth@32473/src", []string{"result = fail", "user != nagios", "meta@1/origin = /^app/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testdata := []struct {
+		sd     string
+		expect bool
+	}{
+		{`[auth@32473 src="1.2.3.4" result="fail" user="root"][meta@1 origin="app-1"]`, true},
+		{`[auth@32473 src="1.2.3.4" result="fail"][meta@1 origin="app-1"]`, true},
+		{`[auth@32473 src="1.2.3.4" result="ok" user="root"][meta@1 origin="app-1"]`, false},
+		{`[auth@32473 src="1.2.3.4" result="fail" user="nagios"][meta@1 origin="app-1"]`, false},
+		{`[auth@32473 src="1.2.3.4" result="fail" user="root"]`, false},
+		{`[auth@32473 result="fail" user="root"][meta@1 origin="app-1"]`, false},
+	}
+	for _, d := range testdata {
+		sd, err := parseStructuredData(d.sd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		groups := r.match(&message{SD: sd})
+		if (groups != nil) != d.expect {
+			t.Errorf("match(%s) = %v, expected %t", d.sd, groups, d.expect)
+		}
+		if groups != nil && groups["IP"] != "1.2.3.4" {
+			t.Errorf("match(%s) IP = %q, expected 1.2.3.4", d.sd, groups["IP"])
+		}
+	}
+
+	if _, err := newSDRule("src", nil); err == nil {
+		t.Errorf("newSDRule() accepted an sd-ip without SD-ID")
+	}
+}
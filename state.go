@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// statePath returns the path of the named file in the state directory.
+func statePath(name string) string {
+	return filepath.Join(cfg.Settings.StateDir, name)
+}
+
+// loadState reads the named JSON file from the state directory into v.
+// A missing file is not an error, it leaves v untouched.
+func loadState(name string, v interface{}) error {
+	data, err := os.ReadFile(statePath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// saveState writes v as JSON to the named file in the state directory.
+// The file is replaced atomically, so a crash never leaves a half written
+// file behind.
+func saveState(name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(cfg.Settings.StateDir, 0750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(cfg.Settings.StateDir, name+".*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err = tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), statePath(name))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jeromer/syslogparser"
+	"github.com/jeromer/syslogparser/rfc3164"
+	"github.com/jeromer/syslogparser/rfc5424"
+)
+
+// message is a single log message. The header fields are those of the
+// syslog header, Facility and Severity being -1 for messages without one,
+// like lines read from log files. Tag holds the APP-NAME and SD the
+// structured data of RFC 5424 messages. Time is the timestamp of the
+// message, zero when it has none.
+type message struct {
+	Hostname string
+	Tag      string
+	Facility int
+	Severity int
+	SD       structuredData
+	Text     string
+	Time     time.Time
+
+	json *map[string]string
+}
+
+// textMessage returns a message without header holding text.
+func textMessage(text string) *message {
+	return &message{Facility: -1, Severity: -1, Text: text}
+}
+
+// parseSyslog parses a single syslog message, either RFC 3164 or RFC 5424
+// formatted. The from argument describes the sender.
+func parseSyslog(pkt []byte, from string) (*message, error) {
+	var parser syslogparser.LogParser
+	parser = rfc3164.NewParser(pkt)
+	msg, tag := "content", "tag"
+	if err := parser.Parse(); err != nil {
+		parser = rfc5424.NewParser(pkt)
+		if err = safeParse(parser); err != nil {
+			if m := parseBare(pkt, from); m != nil {
+				return m, nil
+			}
+			return nil, err
+		}
+		msg, tag = "message", "app_name"
+	}
+	logparts := parser.Dump()
+	if hostname, ok := logparts["hostname"].(string); ok && msg == "content" && looksLikeTag(hostname) {
+		// Messages written by syslog(3) to /dev/log lack the hostname,
+		// reparse the message with the hostname filled in.
+		p := rfc3164.NewParser(pkt)
+		p.WithHostname(senderHost(from))
+		if err := p.Parse(); err == nil {
+			logparts = p.Dump()
+		}
+	}
+	m := textMessage(strings.TrimSpace(logparts[msg].(string)))
+	m.Hostname, _ = logparts["hostname"].(string)
+	m.Tag, _ = logparts[tag].(string)
+	m.Time, _ = logparts["timestamp"].(time.Time)
+	if v, ok := logparts["facility"].(int); ok {
+		m.Facility = v
+	}
+	if v, ok := logparts["severity"].(int); ok {
+		m.Severity = v
+	}
+	if v, ok := logparts["structured_data"].(string); ok {
+		sd, err := parseStructuredData(v)
+		if err != nil {
+			return nil, fmt.Errorf("structured data: %w", err)
+		}
+		m.SD = sd
+	}
+	return m, nil
+}
+
+// safeParse runs the parser, turning a panic on malformed input into an
+// error. The rfc5424 parser indexes past the end of short messages.
+func safeParse(parser syslogparser.LogParser) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed message: %v", r)
+		}
+	}()
+	return parser.Parse()
+}
+
+// barePRI matches a message consisting of just a PRI and the text.
+var barePRI = regexp.MustCompile(`^<(\d{1,3})>([^\s<]\S*[\s\S]*)$`)
+
+// parseBare parses a message without header, only a PRI, like RouterOS
+// sends with its default remote logging format: "<86>system,error,critical
+// login failure for user ...". The hostname is that of the sender. It
+// returns nil when pkt is not such a message.
+func parseBare(pkt []byte, from string) *message {
+	res := barePRI.FindSubmatch(pkt)
+	if res == nil {
+		return nil
+	}
+	pri, _ := strconv.Atoi(string(res[1]))
+	if pri > 191 {
+		return nil
+	}
+	m := textMessage(strings.TrimSpace(string(res[2])))
+	m.Hostname = senderHost(from)
+	m.Facility, m.Severity = pri/8, pri%8
+	return m
+}
+
+// handleMessage parses a single syslog message, as received from any of
+// the listeners, and hands it to handleText. The from argument is the
+// address of the sender, id the identity of its TLS client certificate,
+// which is only used for logging.
+func handleMessage(ctx context.Context, mts []*Mikrotik, pkt []byte, from, id string) {
+	msg, err := parseSyslog(pkt, from)
+	if err != nil {
+		log.Printf("%s: %v\n", describePeer(from, id), err)
+		return
+	}
+	handleText(ctx, mts, msg, from, id)
+}
+
+// handleText matches a single message against the configured jails. For
+// every jail matching, the extracted IP is handed to the ban worker of
+// every Mikrotik the jail applies to, or only the one sending the message
+// for local jails.
+func handleText(ctx context.Context, mts []*Mikrotik, msg *message, from, id string) {
+	text := msg.Text
+	sender := senderMikrotik(mts, from)
+	who := describePeer(from, id)
+	for _, m := range cfg.match(msg) {
+		j := m.Jail
+		if *debug {
+			log.Printf("MATCH!!! %s: %s (from %s)\n", j.name, text, who)
+			log.Printf("%#v\n", m.Groups)
+		}
+		if m.IP == nil {
+			log.Printf("%s: Unable to parse ip from %q (%s)\n", j.name, m.Groups["IP"], j.rule(m.Index))
+			continue
+		}
+		if m.Ignore != nil {
+			if cfg.Settings.Verbose {
+				log.Printf("%s: %s: not banning %s, ignored by %q\n", who, j.name, m.IP, m.Ignore.String())
+			}
+			continue
+		}
+		if apiUserFailure(mts, sender, m) {
+			continue
+		}
+		if j.local && sender == nil {
+			if cfg.Settings.Verbose {
+				log.Printf("%s: %s: not banning %s, message did not come from a Mikrotik\n", who, j.name, m.IP)
+			}
+			continue
+		}
+		if j.hits != nil {
+			n, ban := j.hits.hit(m.IP.String(), time.Now())
+			if !ban {
+				if cfg.Settings.Verbose {
+					log.Printf("%s: %s: hit %d/%d for %s\n", who, j.name, n, j.maxretry, m.IP)
+				}
+				continue
+			}
+		}
+		blocktime := j.blocktime
+		if recidive != nil {
+			blocktime = recidive.duration(historyKey(j.name, *m.IP), blocktime, time.Now())
+		}
+		if cfg.Settings.Verbose {
+			log.Printf("%s: %s: banning %s for %s\n", who, j.name, m.IP, blocktime)
+		}
+		var targets []*Mikrotik
+		var names []string
+		for _, mt := range mts {
+			if j.appliesTo(mt.Name) && (!j.local || mt == sender) {
+				targets = append(targets, mt)
+				names = append(names, mt.Name)
+			}
+		}
+		first, hits := bans.record(j.banlist, *m.IP, time.Now().Add(time.Duration(blocktime)), j.name, j.rule(m.Index), text, who, names)
+		comment := newComment(j.name, first, hits).String()
+		for _, mt := range targets {
+			mt.Ban(j.banlist, *m.IP, blocktime, comment)
+		}
+	}
+}
+
+// servePacket reads syslog messages from a datagram socket, be it UDP or
+// a unix datagram socket, until an error occurs. The name is used to
+// describe the sender when the socket does not provide one.
+func servePacket(conn net.PacketConn, name string, d *dispatcher) error {
+	pkt := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(pkt)
+		if err != nil {
+			return err
+		}
+		d.packet(pkt[:n], peerName(addr, name))
+	}
+}
+
+// peerName returns the printable address of a peer, or the fallback when
+// the peer is anonymous, like unbound unix sockets are.
+func peerName(addr net.Addr, fallback string) string {
+	if addr == nil {
+		return fallback
+	}
+	if s := addr.String(); s != "" && s != "@" {
+		return s
+	}
+	return fallback
+}
+
+// senderHost returns the host part of the sender as passed to
+// handleMessage, falling back to our own hostname for local senders.
+func senderHost(from string) string {
+	if host, _, err := net.SplitHostPort(from); err == nil {
+		return host
+	}
+	if host, err := os.Hostname(); err == nil {
+		return host
+	}
+	return "localhost"
+}
+
+// looksLikeTag reports whether the hostname found in a RFC 3164 header is
+// really the tag of the message. Hostnames never contain '[' nor end in ':',
+// while tags like "sshd[123]:" always do.
+func looksLikeTag(hostname string) bool {
+	return strings.HasSuffix(hostname, ":") || strings.Contains(hostname, "[")
+}
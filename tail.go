@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/howeyc/fsnotify"
+)
+
+const (
+	// offsetsFile is the name of the file in the state directory holding
+	// the read offsets of the tailed files.
+	offsetsFile = "offsets.json"
+	// headLen is the number of bytes at the start of a file used to
+	// recognize it again after a restart.
+	headLen = 256
+)
+
+// fileOffset is the persisted state of a single tailed file. Head is a hash
+// over the first HeadLen bytes of the file, used to detect a file which got
+// rotated while we were not running.
+type fileOffset struct {
+	Offset  int64
+	Head    string
+	HeadLen int
+}
+
+// tailer follows a single log file, like tail -F does. It survives the file
+// being renamed (rotated) or truncated underneath it.
+type tailer struct {
+	path   string
+	file   *os.File
+	offset int64
+	head   string
+	hlen   int
+}
+
+// open opens the file at the tailers path. When the saved offset belongs
+// to the same file, reading continues from there. A file which is seen for
+// the first time is read from the end when fromEnd is set, or else from
+// the start.
+func (t *tailer) open(saved *fileOffset, fromEnd bool) error {
+	f, err := os.Open(t.path)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	t.file, t.offset, t.head, t.hlen = f, 0, "", 0
+	switch {
+	case saved != nil && saved.Offset <= fi.Size() && t.fingerprint(saved.HeadLen) == saved.Head:
+		t.offset = saved.Offset
+	case saved == nil && fromEnd:
+		t.offset = fi.Size()
+	}
+	t.updateHead()
+	_, err = f.Seek(t.offset, io.SeekStart)
+	return err
+}
+
+// fingerprint returns the hash over the first n bytes of the file.
+func (t *tailer) fingerprint(n int) string {
+	buf := make([]byte, n)
+	n, _ = t.file.ReadAt(buf, 0)
+	sum := sha256.Sum256(buf[:n])
+	return hex.EncodeToString(sum[:])
+}
+
+// updateHead recalculates the fingerprint, until the file is large enough
+// to cover headLen bytes.
+func (t *tailer) updateHead() {
+	if t.hlen >= headLen {
+		return
+	}
+	fi, err := t.file.Stat()
+	if err != nil {
+		return
+	}
+	t.hlen = int(min(fi.Size(), headLen))
+	t.head = t.fingerprint(t.hlen)
+}
+
+// readLines hands every complete line in the file after the current offset
+// to fn. A partial line at the end of the file is left for the next round.
+func (t *tailer) readLines(fn func(string)) {
+	r := bufio.NewReader(t.file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		t.offset += int64(len(line))
+		if line = bytes.TrimRight(line, "\r\n"); len(line) != 0 {
+			fn(string(line))
+		}
+	}
+	_, _ = t.file.Seek(t.offset, io.SeekStart)
+	t.updateHead()
+}
+
+// poll reads everything which got appended to the file since the last call
+// and checks if the file got rotated or truncated. It reports whether the
+// offset changed.
+func (t *tailer) poll(fn func(string)) bool {
+	old := t.offset
+	if t.file == nil {
+		if err := t.open(nil, false); err != nil {
+			return false
+		}
+		if *debug {
+			log.Printf("%s: opened", t.path)
+		}
+		t.readLines(fn)
+		return true
+	}
+	t.readLines(fn)
+	cur, err := t.file.Stat()
+	if err != nil {
+		return t.offset != old
+	}
+	if fi, err := os.Stat(t.path); err != nil || !os.SameFile(fi, cur) {
+		// The file got rotated, we finished reading the old file above,
+		// continue with the new one (or wait for it to appear).
+		if *debug || cfg.Settings.Verbose {
+			log.Printf("%s: rotated", t.path)
+		}
+		_ = t.file.Close()
+		t.file = nil
+		if err == nil {
+			t.poll(fn)
+		}
+		return true
+	}
+	if cur.Size() < t.offset {
+		if *debug || cfg.Settings.Verbose {
+			log.Printf("%s: truncated", t.path)
+		}
+		t.offset, t.head, t.hlen = 0, "", 0
+		_, _ = t.file.Seek(0, io.SeekStart)
+		t.readLines(fn)
+		return true
+	}
+	return t.offset != old
+}
+
+// state returns the persistable state of the tailer.
+func (t *tailer) state() fileOffset {
+	return fileOffset{t.offset, t.head, t.hlen}
+}
+
+// tailFiles follows all configured log files, matching every line against
+// the configured regexps. fsnotify is used to notice changes quickly, the
+// files are polled every second as well for the cases where fsnotify does
+// not see the change (NFS and friends). The read offsets are saved in the
+// state directory so a restart continues where we left off.
+func tailFiles(ctx context.Context, files map[string]*ConfigFile, d *dispatcher) error {
+	offsets := make(map[string]fileOffset)
+	if err := loadState(offsetsFile, &offsets); err != nil {
+		return err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	var (
+		tailers []*tailer
+		names   []string
+		dirs    = make(map[string]bool)
+	)
+	for k, v := range files {
+		if v.Disabled {
+			log.Printf("%s: definition disabled, skipping\n", k)
+			continue
+		}
+		for _, path := range v.Path {
+			t := &tailer{path: path}
+			var saved *fileOffset
+			if o, ok := offsets[path]; ok {
+				saved = &o
+			}
+			if err = t.open(saved, true); err != nil {
+				log.Printf("%s: %v, waiting for it to appear", k, err)
+			}
+			tailers = append(tailers, t)
+			names = append(names, k)
+			dir := filepath.Dir(path)
+			if !dirs[dir] {
+				if err = watcher.Watch(dir); err != nil {
+					log.Printf("%s: unable to watch %s: %v, polling only", k, dir, err)
+				}
+				dirs[dir] = true
+			}
+		}
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		var dirty bool
+		for {
+			var save bool
+			select {
+			case <-ctx.Done():
+				return
+			case <-watcher.Event:
+			case err := <-watcher.Error:
+				log.Printf("fsnotify: %v", err)
+			case <-ticker.C:
+				save = true
+			}
+			for i, t := range tailers {
+				from := names[i] + ":" + t.path
+				if t.poll(func(line string) { d.line(ctx, line, from) }) {
+					dirty = true
+				}
+			}
+			// Only save once a second, no matter how busy the files are.
+			if save && dirty {
+				for _, t := range tailers {
+					offsets[t.path] = t.state()
+				}
+				if err := saveState(offsetsFile, offsets); err != nil {
+					log.Printf("Unable to save file offsets: %v", err)
+				} else {
+					dirty = false
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func appendFile(t *testing.T, path, data string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func pollLines(t *testing.T, tl *tailer, expect ...string) {
+	t.Helper()
+	var got []string
+	tl.poll(func(line string) { got = append(got, line) })
+	if strings.Join(got, "|") != strings.Join(expect, "|") {
+		t.Errorf("poll() returned %q, expected %q", got, expect)
+	}
+}
+
+func TestTailer(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "auth.log")
+	appendFile(t, path, "old line 1\nold line 2\n")
+
+	// A new file is read from the end, so history is not banned again.
+	tl := &tailer{path: path}
+	if err := tl.open(nil, true); err != nil {
+		t.Fatal(err)
+	}
+	pollLines(t, tl)
+
+	appendFile(t, path, "line 1\nline 2\npartial")
+	pollLines(t, tl, "line 1", "line 2")
+	appendFile(t, path, " line 3\n")
+	pollLines(t, tl, "partial line 3")
+
+	// Rotation: the remainder of the old file is read, followed by
+	// everything in the new file.
+	appendFile(t, path, "line 4\n")
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path+".1", "line 5\n")
+	appendFile(t, path, "new line 1\n")
+	pollLines(t, tl, "line 4", "line 5", "new line 1")
+
+	// Truncation restarts at the start of the file.
+	if err := os.Truncate(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	pollLines(t, tl)
+	appendFile(t, path, "truncated 1\n")
+	pollLines(t, tl, "truncated 1")
+
+	// A restart with the saved state continues where we left off.
+	saved := tl.state()
+	appendFile(t, path, "after restart\n")
+	tl2 := &tailer{path: path}
+	if err := tl2.open(&saved, true); err != nil {
+		t.Fatal(err)
+	}
+	pollLines(t, tl2, "after restart")
+
+	// Unless the file got rotated in the meantime.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	appendFile(t, path, "rotated while down\n")
+	tl3 := &tailer{path: path}
+	if err := tl3.open(&saved, true); err != nil {
+		t.Fatal(err)
+	}
+	pollLines(t, tl3, "rotated while down")
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxFrameSize is the largest syslog frame we accept over a stream
+// connection. Anything larger is discarded.
+const maxFrameSize = 64 * 1024
+
+var errFrameTooLong = errors.New("syslog frame too long")
+
+// readFrame returns the next syslog message from r. It handles both framing
+// methods of RFC 6587: octet-counting ("MSG-LEN SP SYSLOG-MSG") and the
+// non-transparent framing, where each message is terminated by a LF.
+// The method is detected per frame, as a syslog message always starts
+// with a '<' and a message length with a non-zero digit.
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] >= '1' && b[0] <= '9' {
+			return readOctetCounted(r)
+		}
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Swallow the remainder of the oversized frame.
+			for err == bufio.ErrBufferFull {
+				_, err = r.ReadSlice('\n')
+			}
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			return nil, errFrameTooLong
+		}
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			// Skip empty lines, some senders like to end with "\r\n\n".
+			continue
+		}
+		return append([]byte(nil), line...), nil
+	}
+}
+
+// readOctetCounted reads a single octet-counted frame from r.
+func readOctetCounted(r *bufio.Reader) ([]byte, error) {
+	var digits []byte
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == ' ' {
+			break
+		}
+		if b < '0' || b > '9' || len(digits) > 6 {
+			return nil, fmt.Errorf("malformed octet count %q", append(digits, b))
+		}
+		digits = append(digits, b)
+	}
+	n, err := strconv.Atoi(string(digits))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrameSize {
+		if _, err = r.Discard(n); err != nil {
+			return nil, err
+		}
+		return nil, errFrameTooLong
+	}
+	frame := make([]byte, n)
+	if _, err = io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(frame, "\r\n"), nil
+}
+
+// serveTCP accepts syslog connections on l and hands every frame received
+// to the dispatcher. Each connection is served by its own goroutine. It is
+// used for both the plain TCP and the TLS listener.
+func serveTCP(ctx context.Context, l net.Listener, d *dispatcher) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("accept: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go serveConn(ctx, conn, peerName(conn.RemoteAddr(), l.Addr().String()), d)
+	}
+}
+
+// serveConn reads frames from a single stream connection until it is
+// closed by the sender or turns out to be garbage.
+func serveConn(ctx context.Context, conn net.Conn, from string, d *dispatcher) {
+	defer func() { _ = conn.Close() }()
+	var id string
+	if tc, ok := conn.(*tls.Conn); ok {
+		// Do the handshake upfront, so we know who we are talking to.
+		hctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := tc.HandshakeContext(hctx)
+		cancel()
+		if err != nil {
+			log.Printf("%s: %v", from, err)
+			return
+		}
+		id = tlsIdentity(tc.ConnectionState())
+	}
+	who := describePeer(from, id)
+	if *debug {
+		log.Printf("%s: connection opened", who)
+		defer log.Printf("%s: connection closed", who)
+	}
+	r := bufio.NewReaderSize(conn, maxFrameSize)
+	for {
+		frame, err := readFrame(r)
+		if err == errFrameTooLong {
+			log.Printf("%s: %v, skipped", who, err)
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("%s: %v", who, err)
+			}
+			return
+		}
+		d.frame(ctx, frame, from, id)
+	}
+}
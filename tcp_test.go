@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestReadFrame(t *testing.T) {
+	testdata := []struct {
+		name   string
+		in     string
+		expect []string
+		err    error
+	}{
+		{"NonTransparent", "<34>msg one\n<34>msg two\n", []string{"<34>msg one", "<34>msg two"}, io.EOF},
+		{"CRLF", "<34>msg one\r\n\r\n<34>msg two\r\n", []string{"<34>msg one", "<34>msg two"}, io.EOF},
+		{"MissingFinalLF", "<34>msg one\n<34>msg two", []string{"<34>msg one", "<34>msg two"}, io.EOF},
+		{"OctetCounting", "11 <34>msg one11 <34>msg two", []string{"<34>msg one", "<34>msg two"}, io.EOF},
+		{"OctetCountingWithLF", "12 <34>msg one\n", []string{"<34>msg one"}, io.EOF},
+		{"Mixed", "11 <34>msg one<34>msg two\n", []string{"<34>msg one", "<34>msg two"}, io.EOF},
+		{"EmbeddedLF", "15 <34>msg\none\ntwo", []string{"<34>msg\none\ntwo"}, io.EOF},
+		{"ShortFrame", "20 <34>msg one", nil, io.ErrUnexpectedEOF},
+		{"Truncated", "99999 <34>msg one", nil, io.EOF},
+	}
+	for _, d := range testdata {
+		t.Run(d.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(d.in), maxFrameSize)
+			var got []string
+			var err error
+			for {
+				var frame []byte
+				if frame, err = readFrame(r); err != nil {
+					break
+				}
+				got = append(got, string(frame))
+			}
+			if err != d.err {
+				t.Errorf("readFrame(%q) returned error %v, expected %v", d.in, err, d.err)
+			}
+			if strings.Join(got, "|") != strings.Join(d.expect, "|") {
+				t.Errorf("readFrame(%q) returned %q, expected %q", d.in, got, d.expect)
+			}
+		})
+	}
+}
+
+func TestReadFrameOversized(t *testing.T) {
+	huge := "<34>" + strings.Repeat("x", 2*maxFrameSize)
+	testdata := []struct {
+		name string
+		in   string
+	}{
+		{"NonTransparent", huge + "\n<34>msg two\n"},
+		{"OctetCounting", fmt.Sprintf("%d %s11 <34>msg two", len(huge), huge)},
+	}
+	for _, d := range testdata {
+		t.Run(d.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(strings.NewReader(d.in), maxFrameSize)
+			if _, err := readFrame(r); err != errFrameTooLong {
+				t.Fatalf("readFrame() returned %v, expected %v", err, errFrameTooLong)
+			}
+			frame, err := readFrame(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(frame) != "<34>msg two" {
+				t.Errorf("readFrame() returned %q, expected %q", frame, "<34>msg two")
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// testRegex implements the test-regex subcommand. Every argument is either
+// the name of a file to read lines from ("-" being stdin) or, when no such
+// file exists, a line to test itself. For each line it prints which regexp
+// matched, all named groups, the resulting prefix and whether the prefix
+// would be whitelisted on each of the configured Mikrotiks. Jails needing
+// more than one hit show their threshold, lines are tested on their own.
+func testRegex(args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New("usage: mikrotik-fwban [flags] test-regex <line|file|->...")
+	}
+	wl := newWhitelists(&cfg)
+	n := 0
+	for _, arg := range args {
+		var r io.Reader
+		var closer func() error
+		switch fi, err := os.Stat(arg); {
+		case arg == "-":
+			r = os.Stdin
+		case err == nil && fi.Mode().IsRegular():
+			f, err := os.Open(arg)
+			if err != nil {
+				return err
+			}
+			r, closer = f, f.Close
+		default:
+			r = strings.NewReader(arg)
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxFrameSize)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				continue
+			}
+			n++
+			testLine(w, wl, n, line)
+		}
+		if closer != nil {
+			_ = closer()
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// testLine prints the outcome of matching a single line.
+func testLine(w io.Writer, wl *whitelists, n int, line string) {
+	_, _ = fmt.Fprintf(w, "line %d: %s\n", n, line)
+	msg := lineMessage(line)
+	if msg.Text != line {
+		_, _ = fmt.Fprintf(w, "  text:    %s\n", msg.Text)
+	}
+	ms := cfg.match(msg)
+	if len(ms) == 0 {
+		_, _ = fmt.Fprintf(w, "  no match\n")
+		return
+	}
+	for _, m := range ms {
+		_, _ = fmt.Fprintf(w, "  regexp:  %s#%d %s\n", m.Jail.name, m.Index, m.Jail.rule(m.Index))
+		var names []string
+		if m.Index < len(m.Jail.re) {
+			names = m.Jail.re[m.Index].RE.SubexpNames()
+		} else {
+			for name := range m.Groups {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		for _, name := range names {
+			if name != "" {
+				_, _ = fmt.Fprintf(w, "  group:   %s=%q\n", name, m.Groups[name])
+			}
+		}
+		if m.IP == nil {
+			_, _ = fmt.Fprintf(w, "  prefix:  unable to parse %q\n", m.Groups["IP"])
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "  prefix:  %s\n", m.IP)
+		if m.Ignore != nil {
+			_, _ = fmt.Fprintf(w, "  ignored: by %s\n", m.Ignore)
+			continue
+		}
+		if m.Jail.hits != nil {
+			_, _ = fmt.Fprintf(w, "  needs:   %d hits within %s\n", m.Jail.maxretry, m.Jail.hits.findtime)
+		}
+		for _, name := range wl.names {
+			switch e := wl.lookup(name, *m.IP); {
+			case !m.Jail.appliesTo(name):
+				_, _ = fmt.Fprintf(w, "  %s: not in jail\n", name)
+			case e != nil:
+				_, _ = fmt.Fprintf(w, "  %s: whitelisted by %s\n", name, e)
+			case len(wl.unresolved[name]) != 0:
+				_, _ = fmt.Fprintf(w, "  %s: banned, unless on %s\n", name, strings.Join(wl.unresolved[name], ", "))
+			default:
+				_, _ = fmt.Fprintf(w, "  %s: banned\n", name)
+			}
+		}
+	}
+}
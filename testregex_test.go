@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTestRegex(t *testing.T) {
+	var err error
+	cfg, err = newConfigString(replayConfig, 0, 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = testRegex([]string{
+		"<38>Oct 11 22:14:15 host sshd[123]: Failed password for invalid user admin from 60.173.26.187 port 8962 ssh2",
+		"Failed password for root from 192.168.10.5 port 8962 ssh2",
+		"Accepted password for root from 192.168.10.5 port 8962 ssh2",
+		"Failed password for nagios from 60.173.26.187 port 8962 ssh2",
+	}, &out); err != nil {
+		t.Fatal(err)
+	}
+	expect := `line 1: <38>Oct 11 22:14:15 host sshd[123]: Failed password for invalid user admin from 60.173.26.187 port 8962 ssh2
+  text:    Failed password for invalid user admin from 60.173.26.187 port 8962 ssh2
+  regexp:  default#0 Failed password for(?: invalid user)? (?P<USER>\S+) from (?P<IP>\S+) port \d+ ssh2
+  group:   USER="admin"
+  group:   IP="60.173.26.187"
+  prefix:  60.173.26.187/32
+  MT-1: banned, unless on @admins
+line 2: Failed password for root from 192.168.10.5 port 8962 ssh2
+  regexp:  default#0 Failed password for(?: invalid user)? (?P<USER>\S+) from (?P<IP>\S+) port \d+ ssh2
+  group:   USER="root"
+  group:   IP="192.168.10.5"
+  prefix:  192.168.10.5/32
+  MT-1: whitelisted by 192.168.10.0/24
+line 3: Accepted password for root from 192.168.10.5 port 8962 ssh2
+  no match
+line 4: Failed password for nagios from 60.173.26.187 port 8962 ssh2
+  regexp:  default#0 Failed password for(?: invalid user)? (?P<USER>\S+) from (?P<IP>\S+) port \d+ ssh2
+  group:   USER="nagios"
+  group:   IP="60.173.26.187"
+  prefix:  60.173.26.187/32
+  ignored: by USER =~ ^nagios$
+`
+	if out.String() != expect {
+		t.Errorf("testRegex() output does not match\n---\n%s---\n%s---\n", out.String(), expect)
+	}
+}
+
+func TestTestRegexMaxRetry(t *testing.T) {
+	var err error
+	cfg, err = newConfigString("[settings]\n maxretry = 2\n"+replayConfig, 0, 0, 0, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err = testRegex([]string{"Failed password for root from 60.173.26.187 port 8962 ssh2"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if expect := "  prefix:  60.173.26.187/32\n  needs:   2 hits within 10m0s\n  MT-1: banned"; !strings.Contains(out.String(), expect) {
+		t.Errorf("testRegex() output does not contain %q\n---\n%s---\n", expect, out.String())
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// hitCounter counts the hits per prefix within a sliding window of
+// findtime, so a prefix is only banned after maxretry hits. It tracks at
+// most size prefixes, when full the prefix hit least recently is dropped.
+// The prefixes are kept in order of their last hit, most recent first, so
+// both dropping and expiring only touch the prefixes going away.
+type hitCounter struct {
+	sync.Mutex
+	maxretry int
+	findtime time.Duration
+	size     int
+	hits     map[string]*list.Element
+	order    *list.List // Of *hitEntry, most recently hit first.
+}
+
+// hitEntry holds the hits of a single prefix, oldest first.
+type hitEntry struct {
+	key  string
+	hits []time.Time
+}
+
+func newHitCounter(maxretry int, findtime time.Duration, size int) *hitCounter {
+	return &hitCounter{
+		maxretry: maxretry,
+		findtime: findtime,
+		size:     size,
+		hits:     make(map[string]*list.Element),
+		order:    list.New(),
+	}
+}
+
+// hit records a hit for key at time now. It returns the number of hits
+// within the window and whether that reached maxretry. Once reached, the
+// hits for key are forgotten, so counting starts over.
+func (h *hitCounter) hit(key string, now time.Time) (int, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	el, ok := h.hits[key]
+	if !ok {
+		if len(h.hits) >= h.size {
+			h.evictLocked(now)
+		}
+		el = h.order.PushFront(&hitEntry{key: key})
+		h.hits[key] = el
+	} else {
+		h.order.MoveToFront(el)
+	}
+	e := el.Value.(*hitEntry)
+	// Drop the hits which fell out of the window, and keep at most
+	// maxretry of them.
+	start := 0
+	for start < len(e.hits) && now.Sub(e.hits[start]) > h.findtime {
+		start++
+	}
+	if len(e.hits)-start >= h.maxretry {
+		start = len(e.hits) - h.maxretry + 1
+	}
+	e.hits = append(e.hits[start:], now)
+	n := len(e.hits)
+	if n >= h.maxretry {
+		h.removeLocked(el)
+		return n, true
+	}
+	return n, false
+}
+
+// removeLocked forgets the hits of the entry.
+func (h *hitCounter) removeLocked(el *list.Element) {
+	h.order.Remove(el)
+	delete(h.hits, el.Value.(*hitEntry).key)
+}
+
+// expire forgets all hits older than findtime.
+func (h *hitCounter) expire(now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+	for el := h.order.Back(); el != nil; el = h.order.Back() {
+		e := el.Value.(*hitEntry)
+		if now.Sub(e.hits[len(e.hits)-1]) <= h.findtime {
+			break
+		}
+		h.removeLocked(el)
+	}
+}
+
+// evictLocked drops the key which was hit least recently.
+func (h *hitCounter) evictLocked(now time.Time) {
+	el := h.order.Back()
+	if el == nil {
+		return
+	}
+	e := el.Value.(*hitEntry)
+	if *debug && now.Sub(e.hits[len(e.hits)-1]) <= h.findtime {
+		log.Printf("Hit counter full, forgetting %s", e.key)
+	}
+	h.removeLocked(el)
+}
+
+// len returns the number of keys currently tracked.
+func (h *hitCounter) len() int {
+	h.Lock()
+	defer h.Unlock()
+	return len(h.hits)
+}
+
+// pending returns the number of hits within the window of every key.
+func (h *hitCounter) pending() map[string]int {
+	h.Lock()
+	defer h.Unlock()
+	counts := make(map[string]int, len(h.hits))
+	for k, el := range h.hits {
+		counts[k] = len(el.Value.(*hitEntry).hits)
+	}
+	return counts
+}
+
+// run expires the hits every findtime, until ctx is done.
+func (h *hitCounter) run(ctx context.Context) {
+	ticker := time.NewTicker(h.findtime)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			h.expire(now)
+		}
+	}
+}
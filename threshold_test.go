@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHitCounter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	testdata := []struct {
+		key    string
+		offset time.Duration
+		count  int
+		ban    bool
+	}{
+		{"1.2.3.4/32", 0, 1, false},
+		{"1.2.3.4/32", time.Minute, 2, false},
+		{"5.6.7.8/32", time.Minute, 1, false},
+		{"1.2.3.4/32", 2 * time.Minute, 3, true},
+		// Counting starts over after a ban.
+		{"1.2.3.4/32", 3 * time.Minute, 1, false},
+		// Hits outside the window are forgotten.
+		{"5.6.7.8/32", 12 * time.Minute, 1, false},
+		{"5.6.7.8/32", 13 * time.Minute, 2, false},
+		{"5.6.7.8/32", 14 * time.Minute, 3, true},
+	}
+	h := newHitCounter(3, 10*time.Minute, 100)
+	for _, d := range testdata {
+		t.Run(fmt.Sprintf("%s+%s", d.key, d.offset), func(t *testing.T) {
+			count, ban := h.hit(d.key, start.Add(d.offset))
+			if count != d.count || ban != d.ban {
+				t.Errorf("hit(%s) = %d, %v, expected %d, %v", d.key, count, ban, d.count, d.ban)
+			}
+		})
+	}
+	h.expire(start.Add(time.Hour))
+	if h.len() != 0 {
+		t.Errorf("expire() left %d entries, expected 0", h.len())
+	}
+}
+
+func TestHitCounterBounded(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := newHitCounter(2, time.Hour, 10)
+	for i := 0; i < 100; i++ {
+		h.hit(fmt.Sprintf("10.0.0.%d/32", i), start.Add(time.Duration(i)*time.Second))
+	}
+	if h.len() != 10 {
+		t.Errorf("counter tracks %d entries, expected 10", h.len())
+	}
+	// The most recent ones survived.
+	if _, ban := h.hit("10.0.0.99/32", start.Add(time.Minute)); !ban {
+		t.Errorf("expected 10.0.0.99/32 to be banned")
+	}
+}
+
+func TestHitCounterRecency(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := newHitCounter(3, time.Hour, 2)
+	h.hit("a", start)
+	h.hit("b", start.Add(time.Second))
+	h.hit("a", start.Add(2*time.Second))
+	// Hitting a again made b the least recently hit, so c pushes b out.
+	h.hit("c", start.Add(3*time.Second))
+	if n, ban := h.hit("a", start.Add(4*time.Second)); n != 3 || !ban {
+		t.Errorf("hit(a) = %d, %v, expected 3, true", n, ban)
+	}
+	if n, _ := h.hit("b", start.Add(5*time.Second)); n != 1 {
+		t.Errorf("hit(b) = %d, expected b to be forgotten", n)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// newTLSConfig builds the server side TLS configuration for the RFC 5425
+// listener. When a CA bundle is configured, clients are required to present
+// a certificate signed by one of its CAs.
+func newTLSConfig(certfile, keyfile, cafile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+	if err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cafile != "" {
+		pem, err := os.ReadFile(cafile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", cafile)
+		}
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tc, nil
+}
+
+// tlsIdentity returns a printable identity of the peer of a TLS connection,
+// made up from the subject of the client certificate, or the empty string
+// when none was given. It is used to log which host caused a ban.
+func tlsIdentity(state tls.ConnectionState) string {
+	if len(state.PeerCertificates) == 0 {
+		return ""
+	}
+	leaf := state.PeerCertificates[0]
+	name := leaf.Subject.CommonName
+	if name == "" && len(leaf.DNSNames) != 0 {
+		name = strings.Join(leaf.DNSNames, ",")
+	}
+	if name == "" {
+		name = leaf.Subject.String()
+	}
+	return name
+}
+
+// describePeer returns the sender of a message as logged: its address,
+// followed by the identity of its client certificate, if any. The result
+// is only meant for humans, the address is used as is everywhere else.
+func describePeer(from, id string) string {
+	if id == "" {
+		return from
+	}
+	return fmt.Sprintf("%s[%s]", from, id)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert returns a certificate for name, signed by parent or self-signed
+// when parent is nil, together with its key.
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// writePEM writes the certificate, or the key when cert is nil, to a file
+// in dir, returning its name.
+func writePEM(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) string {
+	t.Helper()
+	block := &pem.Block{Type: "CERTIFICATE"}
+	if cert != nil {
+		block.Bytes = cert.Raw
+	} else {
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.Type, block.Bytes = "EC PRIVATE KEY", der
+	}
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := testCert(t, "fwban test CA", nil, nil)
+	server, serverKey := testCert(t, "fwban", ca, caKey)
+	client, clientKey := testCert(t, "gw1", ca, caKey)
+
+	tc, err := newTLSConfig(writePEM(t, dir, "server.crt", server, nil), writePEM(t, dir, "server.key", nil, serverKey), writePEM(t, dir, "ca.crt", ca, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, expected client certificates to be required", tc.ClientAuth)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &dispatcher{inbox: make(chan inbound, 4)}
+	go serveTCP(ctx, l, d)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	send := func(certs []tls.Certificate, msg string) error {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{RootCAs: roots, Certificates: certs})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = conn.Close() }()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return err
+		}
+		// The server never writes, so reading waits for it to hang up
+		// on us, or for the deadline when it kept the connection.
+		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1))
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil
+		}
+		return err
+	}
+
+	// Without a client certificate the server refuses the connection.
+	if err := send(nil, "<34>anonymous\n"); err == nil {
+		t.Errorf("connection without client certificate was accepted")
+	}
+	// With one, the sender is identified by its certificate.
+	cert := tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey}
+	if err := send([]tls.Certificate{cert}, "<34>identified\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case in := <-d.inbox:
+		if string(in.pkt) != "<34>identified" {
+			t.Errorf("received %q, expected only the message of the identified client", in.pkt)
+		}
+		// The identity is kept apart, the address stays host:port.
+		if in.id != "gw1" {
+			t.Errorf("identity = %q, expected the client certificate name gw1", in.id)
+		}
+		if _, _, err := net.SplitHostPort(in.from); err != nil {
+			t.Errorf("sender = %q, expected host:port: %v", in.from, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+}
+
+func TestTLSIdentity(t *testing.T) {
+	ca, caKey := testCert(t, "fwban test CA", nil, nil)
+	named, _ := testCert(t, "gw1", ca, caKey)
+	testdata := []struct {
+		name   string
+		state  tls.ConnectionState
+		expect string
+	}{
+		{"NoCertificate", tls.ConnectionState{}, ""},
+		{"CommonName", tls.ConnectionState{PeerCertificates: []*x509.Certificate{named}}, "gw1"},
+		{"DNSNames", tls.ConnectionState{PeerCertificates: []*x509.Certificate{{DNSNames: []string{"a.example", "b.example"}}}}, "a.example,b.example"},
+		{"Subject", tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{Organization: []string{"Example"}}}}}, "O=Example"},
+	}
+	for _, d := range testdata {
+		t.Run(d.name, func(t *testing.T) {
+			if got := tlsIdentity(d.state); got != d.expect {
+				t.Errorf("tlsIdentity() = %q, expected %q", got, d.expect)
+			}
+		})
+	}
+	if got := describePeer("192.0.2.1:6514", "gw1"); got != "192.0.2.1:6514[gw1]" {
+		t.Errorf("describePeer() = %q, expected %q", got, "192.0.2.1:6514[gw1]")
+	}
+	if got := describePeer("192.0.2.1:6514", ""); got != "192.0.2.1:6514" {
+		t.Errorf("describePeer() = %q, expected %q", got, "192.0.2.1:6514")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// serveUnix creates the local unix socket at path and feeds the messages
+// received on it into the dispatcher, just like the UDP and TCP listeners.
+// A stale socket left behind by a previous run is removed first.
+func serveUnix(ctx context.Context, path, typ string, mode os.FileMode, d *dispatcher) error {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return &os.PathError{Op: "listen", Path: path, Err: errors.New("exists and is not a socket")}
+		}
+		if err = os.Remove(path); err != nil {
+			return err
+		}
+	}
+	if typ == "stream" {
+		var l *net.UnixListener
+		err := bindUnix(path, mode, func(tmp string) error {
+			var err error
+			l, err = net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+			return err
+		})
+		if err != nil {
+			if l != nil {
+				_ = l.Close()
+			}
+			return err
+		}
+		// It lives under another name now, removing it is up to us.
+		l.SetUnlinkOnClose(false)
+		go serveTCP(ctx, l, d)
+		return nil
+	}
+	var conn net.PacketConn
+	err := bindUnix(path, mode, func(tmp string) error {
+		var err error
+		conn, err = net.ListenPacket("unixgram", tmp)
+		return err
+	})
+	if err != nil {
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return err
+	}
+	go func() {
+		log.Fatalln(servePacket(conn, path, d))
+	}()
+	return nil
+}
+
+// bindUnix creates a unix socket at path with the given mode, using bind
+// to create it at the temporary name it is passed. The socket is created
+// in a private directory next to path and only renamed into place once
+// its mode is set, so it is never reachable with the mode the umask gave
+// it.
+func bindUnix(path string, mode os.FileMode, bind func(tmp string) error) error {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".fwban-")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+	tmp := filepath.Join(dir, "sock")
+	if err = bind(tmp); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmp, mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestServeUnix(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Anything but a socket is left alone.
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := serveUnix(ctx, file, "dgram", 0666, &dispatcher{}); err == nil {
+		t.Errorf("serveUnix() replaced a regular file")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("regular file got removed: %v", err)
+	}
+
+	for _, d := range []struct {
+		typ, network string
+		mode         os.FileMode
+	}{
+		{"dgram", "unixgram", 0620},
+		{"stream", "unix", 0600},
+	} {
+		t.Run(d.typ, func(t *testing.T) {
+			path := filepath.Join(dir, d.typ+".sock")
+			// Leave a stale socket behind, as a crashed run would.
+			stale, err := net.Listen("unix", path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stale.(*net.UnixListener).SetUnlinkOnClose(false)
+			_ = stale.Close()
+
+			disp := &dispatcher{inbox: make(chan inbound, 1)}
+			if err := serveUnix(ctx, path, d.typ, d.mode, disp); err != nil {
+				t.Fatal(err)
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() != d.mode {
+				t.Errorf("socket mode = %v, expected %v", fi.Mode().Perm(), d.mode)
+			}
+
+			conn, err := net.Dial(d.network, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = conn.Close() }()
+			if _, err := conn.Write([]byte("<38>sshd: Failed password\n")); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case in := <-disp.inbox:
+				// Datagrams are passed on as is, stream frames without LF.
+				if got := string(in.pkt); got != "<38>sshd: Failed password\n" && got != "<38>sshd: Failed password" {
+					t.Errorf("received %q", got)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message received")
+			}
+		})
+	}
+}
+
+func TestBindUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "fwban.sock")
+	var l net.Listener
+	err := bindUnix(path, 0666, func(tmp string) error {
+		// The socket is bound where nobody else can reach it.
+		if _, err := os.Lstat(path); err == nil {
+			t.Errorf("%s exists before its mode is set", path)
+		}
+		fi, err := os.Stat(filepath.Dir(tmp))
+		if err != nil {
+			return err
+		}
+		if fi.Mode().Perm() != 0700 {
+			t.Errorf("socket is bound in a directory with mode %v, expected 0700", fi.Mode().Perm())
+		}
+		l, err = net.Listen("unix", tmp)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	if fi, err := os.Lstat(path); err != nil || fi.Mode().Perm() != 0666 {
+		t.Errorf("socket = %v, %v, expected mode 0666", fi, err)
+	}
+	// The private directory is gone again.
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Errorf("ReadDir() = %v, %v, expected only the socket", entries, err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net"
+	"runtime"
+	"time"
+)
+
+const (
+	// inboxSize is the number of received messages waiting to be matched.
+	inboxSize = 4096
+	// banQueueSize is the number of bans waiting for a single Mikrotik.
+	banQueueSize = 1024
+	// batchWindow is how long the ban worker waits for more bans to send
+	// along with the first one, up to maxBatch bans.
+	batchWindow = 50 * time.Millisecond
+	maxBatch    = 100
+)
+
+// Metrics, published by expvar on /debug/vars of the metricsaddr listener.
+// The fwban map holds the counters of the receivers, the fwban_mikrotik map
+// those of every Mikrotik.
+var (
+	metrics         = expvar.NewMap("fwban")
+	mikrotikMetrics = expvar.NewMap("fwban_mikrotik")
+)
+
+// inbound is a message waiting to be matched, either a raw syslog message
+// or a line read from a file. From is the address of the sender, id the
+// identity of its TLS client certificate, if any.
+type inbound struct {
+	pkt  []byte
+	msg  *message
+	from string
+	id   string
+}
+
+// dispatcher decouples receiving messages from matching them, and matching
+// from updating the Mikrotiks. Receivers put the messages in the bounded
+// inbox, which is drained by a matcher per CPU. Bans are handed to the ban
+// worker of every Mikrotik, each with its own bounded queue, so a slow or
+// unreachable Mikrotik never holds back the receivers, nor the others.
+type dispatcher struct {
+	mts   []*Mikrotik
+	inbox chan inbound
+
+	received expvar.Int
+	dropped  expvar.Int
+}
+
+// newDispatcher starts the matchers for mts, until ctx is done.
+func newDispatcher(ctx context.Context, mts []*Mikrotik) *dispatcher {
+	d := &dispatcher{mts: mts, inbox: make(chan inbound, inboxSize)}
+	metrics.Set("received", &d.received)
+	metrics.Set("dropped", &d.dropped)
+	metrics.Set("inbox", expvar.Func(func() interface{} { return len(d.inbox) }))
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go d.match(ctx)
+	}
+	go d.report(ctx)
+	return d
+}
+
+// match handles the messages in the inbox.
+func (d *dispatcher) match(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case in := <-d.inbox:
+			if in.msg == nil {
+				handleMessage(ctx, d.mts, in.pkt, in.from, in.id)
+			} else {
+				handleText(ctx, d.mts, in.msg, in.from, in.id)
+			}
+		}
+	}
+}
+
+// packet hands a datagram to the matchers. It never blocks: when the
+// matchers fall behind the message is dropped, just like the kernel would
+// when we stopped reading the socket. The packet is copied, so the caller
+// may reuse its buffer.
+func (d *dispatcher) packet(pkt []byte, from string) {
+	d.received.Add(1)
+	select {
+	case d.inbox <- inbound{pkt: append([]byte(nil), pkt...), from: from}:
+	default:
+		d.dropped.Add(1)
+	}
+}
+
+// frame hands a message received over a stream to the matchers, blocking
+// while the inbox is full. That pushes back on the sender instead of
+// losing messages it was promised delivery of.
+func (d *dispatcher) frame(ctx context.Context, pkt []byte, from, id string) {
+	d.received.Add(1)
+	select {
+	case d.inbox <- inbound{pkt: pkt, from: from, id: id}:
+	case <-ctx.Done():
+	}
+}
+
+// line hands a line read from a log file to the matchers, blocking while
+// the inbox is full, as the file is not going anywhere.
+func (d *dispatcher) line(ctx context.Context, text, from string) {
+	d.received.Add(1)
+	select {
+	case d.inbox <- inbound{msg: textMessage(text), from: from}:
+	case <-ctx.Done():
+	}
+}
+
+// report logs the number of messages dropped and bans spilled every
+// minute, when there were any.
+func (d *dispatcher) report(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	var last int64
+	lastBans := make(map[*Mikrotik]int64)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if n := d.dropped.Value(); n != last {
+			log.Printf("Inbox full, dropped %d messages in the last minute", n-last)
+			last = n
+		}
+		for _, mt := range d.mts {
+			if n := mt.bansSpilled.Value(); n != lastBans[mt] {
+				log.Printf("%s: ban queue full, spilled %d bans to disk in the last minute", mt.Name, n-lastBans[mt])
+				lastBans[mt] = n
+			}
+		}
+	}
+}
+
+// ban is an address to add to a list of a Mikrotik, see AddIP.
+type ban struct {
+	list     string
+	ip       net.IPNet
+	duration Duration
+	comment  string
+}
+
+// Ban hands the ban to the ban worker of the Mikrotik. It never blocks;
+// when the queue is full the ban is spilled to the durable queue, which is
+// saved in the state directory in the background, and counted. A Mikrotik not responding is marked
+// degraded on the first timeout, after which its worker queues bans on
+// disk anyway, so the queue only fills up when the Mikrotik is alive but
+// too slow.
+func (mt *Mikrotik) Ban(list string, ip net.IPNet, duration Duration, comment string) {
+	select {
+	case mt.bans <- ban{list, ip, duration, comment}:
+	default:
+		mt.spill(list, ip, duration, comment)
+		mt.bansSpilled.Add(1)
+		bans.setStatus(list, ip, mt.Name, "queued")
+	}
+}
+
+// banWorker applies the bans handed to Ban, until ctx is done. Bans
+// arriving within batchWindow of each other are added in a single batch.
+// Once it caught up, the bans spilled meanwhile are applied.
+func (mt *Mikrotik) banWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-mt.bans:
+			mt.applyBans(ctx, mt.collectBans(ctx, b))
+			if len(mt.bans) == 0 {
+				mt.unspill(ctx)
+			}
+		}
+	}
+}
+
+// collectBans returns a batch starting with first, together with the bans
+// arriving within batchWindow.
+func (mt *Mikrotik) collectBans(ctx context.Context, first ban) []ban {
+	batch := []ban{first}
+	timer := time.NewTimer(batchWindow)
+	defer timer.Stop()
+	for len(batch) < maxBatch {
+		select {
+		case b := <-mt.bans:
+			batch = append(batch, b)
+		case <-timer.C:
+			return batch
+		case <-ctx.Done():
+			return batch
+		}
+	}
+	return batch
+}
+
+// applyBans adds a batch of bans, aggregating every added entry. Bans for a
+// degraded Mikrotik are queued, as are those failing because the
+// connection broke halfway through the batch.
+func (mt *Mikrotik) applyBans(ctx context.Context, batch []ban) {
+	var todo, lists []ban
+	for _, b := range batch {
+		if mt.queueAdd(b.list, b.ip, b.duration, b.comment) {
+			bans.setStatus(b.list, b.ip, mt.Name, "queued")
+		} else {
+			todo = append(todo, b)
+		}
+	}
+	// addIPs normalizes the lists, the database wants them as given.
+	lists = append(lists, todo...)
+	for i, err := range mt.addIPs(ctx, todo) {
+		b := todo[i]
+		if err != nil {
+			if isConnError(err) && mt.queueAdd(b.list, b.ip, b.duration, b.comment) {
+				bans.setStatus(lists[i].list, b.ip, mt.Name, "queued")
+			} else {
+				bans.setStatus(lists[i].list, b.ip, mt.Name, "failed: "+err.Error())
+				log.Printf("%s: %v", mt.Name, err)
+			}
+			continue
+		}
+		bans.setStatus(lists[i].list, b.ip, mt.Name, "banned")
+		if err := mt.aggregate(ctx, b.list, b.ip); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// metrics returns the counters of the Mikrotik, published in expvar.
+func (mt *Mikrotik) metrics() interface{} {
+	mt.queue.Lock()
+	pending := len(mt.queue.ops)
+	mt.queue.Unlock()
+	return map[string]interface{}{
+		"degraded": mt.Degraded(),
+		"bans":     len(mt.bans),
+		"spilled":  mt.bansSpilled.Value(),
+		"queued":   pending,
+		"drift":    mt.drift.Value(),
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ros "github.com/go-routeros/routeros/v3"
+	"github.com/go-routeros/routeros/v3/proto"
+)
+
+// fakeRouter serves a single API connection on l, accepting any login and
+// adding address list entries, except for 192.0.2.2 which it already has
+// and 192.0.2.3 which it refuses.
+func fakeRouter(t *testing.T, l net.Listener) {
+	t.Helper()
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer func() { _ = conn.Close() }()
+	r, w := proto.NewReader(conn), proto.NewWriter(conn)
+	reply := func(tag string, words ...string) {
+		w.BeginSentence()
+		for _, word := range words {
+			w.WriteWord(word)
+		}
+		if tag != "" {
+			w.WriteWord(".tag=" + tag)
+		}
+		if err := w.EndSentence(); err != nil {
+			t.Error(err)
+		}
+	}
+	for n := 1; ; n++ {
+		sen, err := r.ReadSentence()
+		if err != nil {
+			return
+		}
+		switch {
+		case !strings.HasSuffix(sen.Word, "/add"):
+			reply(sen.Tag, "!done")
+		case sen.Map["address"] == "192.0.2.2/32":
+			reply(sen.Tag, "!trap", "=message=failure: already have such entry")
+			reply(sen.Tag, "!done")
+		case sen.Map["address"] == "192.0.2.3/32":
+			reply(sen.Tag, "!trap", "=message=invalid value for argument address")
+			reply(sen.Tag, "!done")
+		default:
+			reply(sen.Tag, "!done", "=ret=*"+strconv.Itoa(n))
+		}
+	}
+}
+
+func TestDispatcherDrops(t *testing.T) {
+	// No matchers running, so the inbox only fills up.
+	d := &dispatcher{inbox: make(chan inbound, 2)}
+	pkt := []byte("<86>sshd: Failed password")
+	for i := 0; i < 3; i++ {
+		d.packet(pkt, "192.0.2.1:514")
+	}
+	pkt[0] = 'X'
+	if got := d.received.Value(); got != 3 {
+		t.Errorf("received = %d, expected 3", got)
+	}
+	if got := d.dropped.Value(); got != 1 {
+		t.Errorf("dropped = %d, expected 1", got)
+	}
+	if in := <-d.inbox; string(in.pkt) != "<86>sshd: Failed password" {
+		t.Errorf("inbox holds %q, expected a copy of the packet", in.pkt)
+	}
+
+	// Stream messages wait for room instead, until cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.line(ctx, "line", "file")
+	if got := d.dropped.Value(); got != 1 {
+		t.Errorf("dropped = %d after line(), expected 1", got)
+	}
+}
+
+func TestBanQueueFull(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	slow := &Mikrotik{Name: "MT-1", banlist: "blacklist", bans: make(chan ban, 1)}
+	healthy := &Mikrotik{Name: "MT-2", banlist: "blacklist", bans: make(chan ban, 1)}
+	for _, mt := range []*Mikrotik{slow, healthy} {
+		mt.queue.file = queueFile(mt.Name)
+	}
+	ip := func(s string) net.IPNet { return *parseCIDR(s, false) }
+
+	// Spilling does not wait for the disk, even while the queue is
+	// being saved.
+	slow.Ban("", ip("192.0.2.1/32"), Duration(time.Hour), "")
+	slow.queue.saving.Lock()
+	done := make(chan struct{})
+	go func() {
+		slow.Ban("", ip("192.0.2.2/32"), Duration(time.Hour), "")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Ban() waited for the queue to be saved")
+	}
+	slow.queue.saving.Unlock()
+	if _, err := os.Stat(statePath(slow.queue.file)); err == nil {
+		t.Errorf("spilled ban saved right away, expected it to wait for a flush")
+	}
+	if got := slow.bansSpilled.Value(); got != 1 {
+		t.Errorf("bansSpilled = %d, expected 1", got)
+	}
+	// The ban which did not fit is kept on disk, although not degraded.
+	if len(slow.queue.ops) != 1 || slow.queue.ops[0].Net != "192.0.2.2/32" {
+		t.Errorf("queue = %v, expected the spilled ban", slow.queue.ops)
+	}
+	// A full queue of one Mikrotik does not affect the others.
+	healthy.Ban("", ip("192.0.2.1/32"), Duration(time.Hour), "")
+	if len(healthy.bans) != 1 || healthy.bansSpilled.Value() != 0 {
+		t.Errorf("other Mikrotik has %d bans, %d spilled, expected 1 and 0", len(healthy.bans), healthy.bansSpilled.Value())
+	}
+	if m := slow.metrics().(map[string]interface{}); m["bans"] != 1 || m["spilled"] != int64(1) || m["queued"] != 1 {
+		t.Errorf("metrics() = %v, expected 1 waiting, 1 spilled and 1 queued ban", m)
+	}
+}
+
+func TestUnspill(t *testing.T) {
+	cfg.Settings.StateDir = t.TempDir()
+	defer func() { cfg = Config{} }()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	go fakeRouter(t, l)
+	ctx := context.Background()
+	client, err := ros.DialContext(ctx, l.Addr().String(), "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	client.Async()
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist", bans: make(chan ban)}
+	mt.queue.file = queueFile(mt.Name)
+	mt.client.Store(client)
+
+	mt.Ban("", *parseCIDR("192.0.2.1/32", false), Duration(time.Hour), "")
+	mt.Ban("", *parseCIDR("192.0.2.4/32", false), Duration(-time.Hour), "")
+	mt.unspill(ctx)
+	if len(mt.queue.ops) != 0 {
+		t.Errorf("queue = %v, expected it to be applied", mt.queue.ops)
+	}
+	if ips := mt.GetIPs(); len(ips) != 1 || ips[0].Net.String() != "192.0.2.1/32" {
+		t.Errorf("GetIPs() = %v, expected only the live spilled ban to be added", ips)
+	}
+}
+
+func TestAddIPsBatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+	go fakeRouter(t, l)
+
+	ctx := context.Background()
+	client, err := ros.DialContext(ctx, l.Addr().String(), "user", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	client.Async()
+	mt := &Mikrotik{Name: "MT-1", banlist: "blacklist"}
+	mt.client.Store(client)
+
+	var bans []ban
+	for _, s := range []string{"192.0.2.1/32", "192.0.2.2/32", "192.0.2.3/32", "192.0.2.1/32"} {
+		_, ip, _ := net.ParseCIDR(s)
+		bans = append(bans, ban{list: "blacklist", ip: *ip, duration: Duration(time.Hour)})
+	}
+	errs := mt.addIPs(ctx, bans)
+	for i, expect := range []bool{false, false, true, false} {
+		if got := errs[i] != nil; got != expect {
+			t.Errorf("addIPs()[%d] = %v, expected an error: %t", i, errs[i], expect)
+		}
+	}
+	if isConnError(errs[2]) {
+		t.Errorf("addIPs()[2] = %v, expected an error reported by the Mikrotik", errs[2])
+	}
+	if ips := mt.GetIPs(); len(ips) != 1 || ips[0].Net.String() != "192.0.2.1/32" {
+		t.Errorf("GetIPs() = %v, expected only 192.0.2.1/32 to be added", ips)
+	}
+}